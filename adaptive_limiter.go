@@ -0,0 +1,224 @@
+package util
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimiter is a CountingSemaphore whose number of slots changes based on
+// the observed latency of the work it guards. It uses an additive increase,
+// multiplicative decrease (AIMD) algorithm: every fast request which was
+// executed while the limiter was at least half full raises the limit by one,
+// every slow or dropped request cuts the limit by 10%.
+//
+// Internally the limiter creates a semaphore with maxLimit slots and withholds
+// the slots which are above the current limit. When the limit is lowered while
+// all slots are in use the withheld slots are taken as soon as they are
+// released.
+type AdaptiveLimiter struct {
+	sem *CountingSemaphore
+	mu  sync.Mutex
+
+	limit    int // Current concurrency limit
+	minLimit int
+	maxLimit int
+
+	inFlight    int // Slots which are currently acquired by callers
+	parked      int // Slots which are withheld from the semaphore
+	parkPending int // Slots which need to be withheld as soon as they are released
+
+	waiting  int // Callers waiting for a slot in AcquireQueued
+	maxQueue int
+
+	maxLatency time.Duration
+}
+
+// NewAdaptiveLimiter creates a new adaptive limiter. The limit starts at
+// initial and will always stay between minLimit and maxLimit. Requests which
+// take longer than maxLatency to complete cause the limit to be decreased.
+// maxQueue is the number of callers which may wait for a slot in
+// AcquireQueued before new callers get rejected
+func NewAdaptiveLimiter(
+	initial, minLimit, maxLimit int,
+	maxLatency time.Duration,
+	maxQueue int,
+) *AdaptiveLimiter {
+	if minLimit < 1 {
+		minLimit = 1
+	}
+	if maxLimit < minLimit {
+		maxLimit = minLimit
+	}
+	initial = min(max(initial, minLimit), maxLimit)
+
+	var l = &AdaptiveLimiter{
+		sem:        NewCountingSemaphore(maxLimit),
+		limit:      maxLimit,
+		minLimit:   minLimit,
+		maxLimit:   maxLimit,
+		maxQueue:   maxQueue,
+		maxLatency: maxLatency,
+	}
+
+	l.mu.Lock()
+	l.setLimit(initial)
+	l.mu.Unlock()
+	return l
+}
+
+// Limit returns the current concurrency limit
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// InFlight returns the number of slots which are currently acquired
+func (l *AdaptiveLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Try takes a slot if one is available without blocking
+func (l *AdaptiveLimiter) Try() (ok bool) {
+	if !l.sem.Try() {
+		return false
+	}
+	l.mu.Lock()
+	l.inFlight++
+	l.mu.Unlock()
+	return true
+}
+
+// Acquire takes a slot. It blocks until a slot is available
+func (l *AdaptiveLimiter) Acquire() {
+	l.sem.Acquire()
+	l.mu.Lock()
+	l.inFlight++
+	l.mu.Unlock()
+}
+
+// AcquireQueued takes a slot, waiting for one if necessary. If the wait queue
+// is full it returns false immediately without taking a slot. If the context is
+// cancelled while waiting the caller leaves the queue and false is returned
+func (l *AdaptiveLimiter) AcquireQueued(ctx context.Context) (ok bool) {
+	if l.Try() {
+		return true
+	}
+
+	l.mu.Lock()
+	if l.waiting >= l.maxQueue {
+		l.mu.Unlock()
+		return false
+	}
+	l.waiting++
+	l.mu.Unlock()
+
+	var err = l.sem.AcquireContext(ctx)
+
+	l.mu.Lock()
+	l.waiting--
+	if err == nil {
+		l.inFlight++
+	}
+	l.mu.Unlock()
+	return err == nil
+}
+
+// Release a slot without recording a latency sample
+func (l *AdaptiveLimiter) Release() {
+	l.mu.Lock()
+	l.inFlight--
+	if l.parkPending > 0 {
+		// The limit was lowered while this slot was in use. Keep it
+		l.parkPending--
+		l.parked++
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+	l.sem.Release()
+}
+
+// Update feeds a latency sample into the limit algorithm. latency is how long
+// the work took to complete, dropped should be true if the work failed because
+// of a timeout or overload. Update should be called before the slot is
+// released
+func (l *AdaptiveLimiter) Update(latency time.Duration, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if dropped || latency > l.maxLatency {
+		l.setLimit(int(math.Floor(float64(l.limit) * 0.9)))
+	} else if l.inFlight*2 >= l.limit {
+		// Only grow the limit if we're actually using it. Otherwise a quiet
+		// period would raise the limit to the maximum
+		l.setLimit(l.limit + 1)
+	}
+}
+
+// Exec obtains an execution slot, runs the provided function concurrently and
+// then returns the slot. The execution time of the function is used as latency
+// sample
+func (l *AdaptiveLimiter) Exec(f func()) {
+	l.Acquire()
+	go func() {
+		var start = time.Now()
+		f()
+		l.Update(time.Since(start), false)
+		l.Release()
+	}()
+}
+
+// setLimit changes the limit by withholding or returning semaphore slots. The
+// mutex must be held when calling this function
+func (l *AdaptiveLimiter) setLimit(limit int) {
+	limit = min(max(limit, l.minLimit), l.maxLimit)
+
+	for ; l.limit > limit; l.limit-- {
+		if l.sem.tryUncounted() {
+			l.parked++
+		} else {
+			l.parkPending++
+		}
+	}
+	for ; l.limit < limit; l.limit++ {
+		if l.parkPending > 0 {
+			l.parkPending--
+		} else {
+			l.parked--
+			l.sem.Release()
+		}
+	}
+}
+
+// Middleware returns a HTTP handler which limits the concurrency of the next
+// handler. The response time of the handler is used as latency sample. When the
+// wait queue is full the request is rejected with 503 Service Unavailable and a
+// Retry-After header
+func (l *AdaptiveLimiter) Middleware(next http.Handler) http.Handler {
+	var retryAfter = strconv.Itoa(max(int(math.Ceil(l.maxLatency.Seconds())), 1))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request context is cancelled when the client disconnects, so
+		// requests which were abandoned don't keep their place in the queue
+		if !l.AcquireQueued(r.Context()) {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "Server is overloaded, please try again later", http.StatusServiceUnavailable)
+			return
+		}
+
+		var start = time.Now()
+		defer func() {
+			l.Update(time.Since(start), false)
+			l.Release()
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
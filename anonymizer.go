@@ -0,0 +1,220 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// AnonymizeMode is the method used by the Anonymizer to hide IP addresses
+type AnonymizeMode int
+
+const (
+	// AnonymizeMask truncates the address to the mask length. The result
+	// still identifies the network of the client. No key is used
+	AnonymizeMask AnonymizeMode = iota
+
+	// AnonymizeHMAC replaces the address with a keyed HMAC-SHA256 hash of the
+	// masked address. The result is an address of the same family which
+	// looks random, the same network always gets the same pseudonym during
+	// a key period. Without the key the original address can't be recovered,
+	// and addresses from different key periods can't be linked
+	AnonymizeHMAC
+
+	// AnonymizeCryptoPAn encrypts the address with the prefix-preserving
+	// Crypto-PAn scheme and then truncates it to the mask length. Two
+	// addresses which share a prefix of n bits are mapped to two addresses
+	// which also share a prefix of exactly n bits, so subnets can still be
+	// analysed. Like with AnonymizeHMAC the mapping is stable during a key
+	// period
+	AnonymizeCryptoPAn
+)
+
+func (m AnonymizeMode) String() string {
+	switch m {
+	case AnonymizeMask:
+		return "mask"
+	case AnonymizeHMAC:
+		return "hmac"
+	case AnonymizeCryptoPAn:
+		return "crypto-pan"
+	}
+	return "unknown"
+}
+
+// AnonymizePolicy describes how IP addresses are anonymized before they are
+// stored. The mask lengths are the number of bits of the address which are
+// retained, the rest of the address is set to zero before hashing (HMAC) or
+// after encrypting (Crypto-PAn). A mask of 24 bits for IPv4 and 48 bits for
+// IPv6 is commonly considered to be anonymous.
+//
+// IPv4-mapped IPv6 addresses are unmapped and treated as IPv4 addresses
+type AnonymizePolicy struct {
+	V4Mask int
+	V6Mask int
+	Mode   AnonymizeMode
+}
+
+// Anonymizer hides IP addresses according to an AnonymizePolicy. The keys for
+// the HMAC and Crypto-PAn modes are derived from a secret, a new key is used
+// for every rotation period. Periods are aligned to the unix epoch, so all
+// servers which share the secret use the same key at the same time and
+// produce the same pseudonyms
+type Anonymizer struct {
+	policy   AnonymizePolicy
+	secret   []byte
+	rotation time.Duration
+
+	// The key of the last used period is cached
+	mu  sync.Mutex
+	key *anonymizerKey
+}
+
+type anonymizerKey struct {
+	period int64
+	hmac   []byte
+	block  cipher.Block // Crypto-PAn AES cipher
+	pad    ipKey        // Crypto-PAn padding
+}
+
+// MinAnonymizerSecret is the minimum length of the secret of an Anonymizer
+const MinAnonymizerSecret = 32
+
+// NewAnonymizer creates a new IP address anonymizer. The secret is used to
+// derive the keys of the HMAC and Crypto-PAn modes, it must be at least
+// MinAnonymizerSecret random bytes. A short or missing secret would give a
+// mapping which anyone can reproduce, so it returns an error. The key is
+// rotated every rotation period, a rotation of zero uses the same key forever.
+// For the mask mode the secret and the rotation are not used
+func NewAnonymizer(policy AnonymizePolicy, secret []byte, rotation time.Duration) (*Anonymizer, error) {
+	if policy.Mode != AnonymizeMask && len(secret) < MinAnonymizerSecret {
+		return nil, fmt.Errorf(
+			"anonymizer secret is %d bytes, the %s mode needs at least %d bytes",
+			len(secret), policy.Mode, MinAnonymizerSecret,
+		)
+	}
+	return &Anonymizer{
+		policy:   policy,
+		secret:   secret,
+		rotation: rotation,
+	}, nil
+}
+
+// Anonymize anonymizes an address with the key of the current period. Returns
+// the zero Addr if the address is invalid or the mask lengths in the policy
+// are out of range
+func (a *Anonymizer) Anonymize(addr netip.Addr) netip.Addr {
+	return a.AnonymizeAt(addr, time.Now())
+}
+
+// AnonymizeAt anonymizes an address with the key of the period which contains
+// time t. This can be used to anonymize addresses from old logs in the same
+// way they would have been anonymized at the time
+func (a *Anonymizer) AnonymizeAt(addr netip.Addr, t time.Time) netip.Addr {
+	addr = addr.WithZone("").Unmap()
+	if !addr.IsValid() {
+		return netip.Addr{}
+	}
+
+	var bits = a.policy.V6Mask
+	if addr.Is4() {
+		bits = a.policy.V4Mask
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	switch a.policy.Mode {
+	case AnonymizeHMAC:
+		var mac = hmac.New(sha256.New, a.keyAt(t).hmac)
+		mac.Write(prefix.Addr().AsSlice())
+		var sum = mac.Sum(nil)
+		if addr.Is4() {
+			return netip.AddrFrom4([4]byte(sum[:4]))
+		}
+		return netip.AddrFrom16([16]byte(sum[:16]))
+	case AnonymizeCryptoPAn:
+		var key = a.keyAt(t)
+		return cryptoPAn(key.block, key.pad, ipKeyFrom(addr), bits).addr(addr.Is4())
+	}
+	return prefix.Addr()
+}
+
+// keyAt returns the key for the period which contains time t
+func (a *Anonymizer) keyAt(t time.Time) *anonymizerKey {
+	var period int64
+	if a.rotation > 0 {
+		// Floor division, so times before the epoch also get their own period
+		period = t.UnixNano() / int64(a.rotation)
+		if t.UnixNano()%int64(a.rotation) < 0 {
+			period--
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.key == nil || a.key.period != period {
+		a.key = deriveAnonymizerKey(a.secret, period)
+	}
+	return a.key
+}
+
+// deriveAnonymizerKey derives the key of a period from the secret with
+// HMAC-SHA256. The first half of the derived key is the AES key for
+// Crypto-PAn, the second half is encrypted to get the padding
+func deriveAnonymizerKey(secret []byte, period int64) *anonymizerKey {
+	var mac = hmac.New(sha256.New, secret)
+	mac.Write([]byte("anonymizer"))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(period)))
+	var derived = mac.Sum(nil)
+
+	block, err := aes.NewCipher(derived[:16])
+	if err != nil {
+		panic(err) // Only happens if the key has the wrong length
+	}
+	var pad [16]byte
+	block.Encrypt(pad[:], derived[16:])
+
+	return &anonymizerKey{
+		period: period,
+		hmac:   derived,
+		block:  block,
+		pad:    ipKeyFrom(netip.AddrFrom16(pad)),
+	}
+}
+
+// cryptoPAn encrypts the first n bits of an address with the Crypto-PAn
+// scheme, the remaining bits are set to zero. Bit i of the result is bit i of
+// the address flipped by the first bit of the AES encryption of the first i
+// bits of the address followed by the padding
+func cryptoPAn(block cipher.Block, pad, key ipKey, n int) ipKey {
+	var (
+		result = key
+		input  [16]byte
+		output [16]byte
+	)
+	for i := range n {
+		var m = ipKey{hi: ^uint64(0), lo: ^uint64(0)}.mask(i)
+		input = ipKey{
+			hi: key.hi&m.hi | pad.hi&^m.hi,
+			lo: key.lo&m.lo | pad.lo&^m.lo,
+		}.bytes()
+		block.Encrypt(output[:], input[:])
+
+		if output[0]&0x80 != 0 {
+			if i < 64 {
+				result.hi ^= 1 << (63 - i)
+			} else {
+				result.lo ^= 1 << (127 - i)
+			}
+		}
+	}
+	return result.mask(n)
+}
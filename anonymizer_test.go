@@ -0,0 +1,145 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var testSecret = bytes.Repeat([]byte("0123456789abcdef"), 2)
+
+func newTestAnonymizer(t *testing.T, policy AnonymizePolicy, rotation time.Duration) *Anonymizer {
+	t.Helper()
+	a, err := NewAnonymizer(policy, testSecret, rotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// commonPrefixLen returns the number of leading bits two addresses share
+func commonPrefixLen(a, b netip.Addr) int {
+	return ipKeyFrom(a).commonBits(ipKeyFrom(b), a.BitLen())
+}
+
+// TestCryptoPAnVectors checks the implementation against the sample output of
+// the reference implementation of Crypto-PAn
+func TestCryptoPAnVectors(t *testing.T) {
+	var key = []byte{
+		21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+		216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2,
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pad [16]byte
+	block.Encrypt(pad[:], key[16:])
+	var padKey = ipKeyFrom(netip.AddrFrom16(pad))
+
+	for in, want := range map[string]string{
+		"128.11.68.132":   "135.242.180.132",
+		"129.118.74.4":    "134.136.186.123",
+		"130.132.252.244": "133.68.164.234",
+		"141.223.7.43":    "141.167.8.160",
+	} {
+		var got = cryptoPAn(block, padKey, ipKeyFrom(netip.MustParseAddr(in)), 32).addr(true)
+		if got.String() != want {
+			t.Errorf("cryptoPAn(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestAnonymizerPrefixPreserving(t *testing.T) {
+	var a = newTestAnonymizer(t, AnonymizePolicy{V4Mask: 32, V6Mask: 128, Mode: AnonymizeCryptoPAn}, 0)
+	var r = rand.New(rand.NewPCG(5, 6))
+
+	for range 2000 {
+		var x, y netip.Addr
+		if r.IntN(2) == 0 {
+			var b1, b2 [4]byte
+			for i := range b1 {
+				b1[i], b2[i] = byte(r.Uint32()), byte(r.Uint32())
+			}
+			copy(b2[:], b1[:r.IntN(4)]) // Give the addresses a shared prefix
+			x, y = netip.AddrFrom4(b1), netip.AddrFrom4(b2)
+		} else {
+			var b1, b2 [16]byte
+			for i := range b1 {
+				b1[i], b2[i] = byte(r.Uint32()), byte(r.Uint32())
+			}
+			copy(b2[:], b1[:r.IntN(16)])
+			x, y = netip.AddrFrom16(b1), netip.AddrFrom16(b2)
+		}
+
+		var ax, ay = a.Anonymize(x), a.Anonymize(y)
+		if ax.BitLen() != x.BitLen() {
+			t.Fatalf("Anonymize(%s) = %s, the address family changed", x, ax)
+		}
+		if want, got := commonPrefixLen(x, y), commonPrefixLen(ax, ay); want != got {
+			t.Fatalf(
+				"%s and %s share %d bits, but %s and %s share %d bits",
+				x, y, want, ax, ay, got,
+			)
+		}
+	}
+}
+
+func TestAnonymizerMask(t *testing.T) {
+	var a = newTestAnonymizer(t, AnonymizePolicy{V4Mask: 24, V6Mask: 48, Mode: AnonymizeCryptoPAn}, 0)
+	var x = a.Anonymize(netip.MustParseAddr("192.0.2.1"))
+	if x.As4()[3] != 0 {
+		t.Errorf("Anonymize(192.0.2.1) = %s, the host bits are not masked", x)
+	}
+	if y := a.Anonymize(netip.MustParseAddr("::ffff:192.0.2.200")); y != x {
+		t.Errorf("mapped address anonymized to %s, want %s", y, x)
+	}
+
+	a = newTestAnonymizer(t, AnonymizePolicy{V4Mask: 24, V6Mask: 48, Mode: AnonymizeMask}, 0)
+	if got := a.Anonymize(netip.MustParseAddr("2001:db8:1:2::5")); got != netip.MustParseAddr("2001:db8:1::") {
+		t.Errorf("Anonymize(2001:db8:1:2::5) = %s, want 2001:db8:1::", got)
+	}
+}
+
+func TestAnonymizerRotation(t *testing.T) {
+	var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var addr = netip.MustParseAddr("198.51.100.23")
+
+	for _, mode := range []AnonymizeMode{AnonymizeHMAC, AnonymizeCryptoPAn} {
+		var a = newTestAnonymizer(t, AnonymizePolicy{V4Mask: 32, V6Mask: 128, Mode: mode}, time.Hour)
+
+		var first = a.AnonymizeAt(addr, start)
+		if same := a.AnonymizeAt(addr, start.Add(59*time.Minute)); same != first {
+			t.Errorf("%s: output changed within a period: %s and %s", mode, first, same)
+		}
+		if next := a.AnonymizeAt(addr, start.Add(time.Hour)); next == first {
+			t.Errorf("%s: output did not change in the next period: %s", mode, next)
+		}
+		if again := a.AnonymizeAt(addr, start.Add(30*time.Minute)); again != first {
+			t.Errorf("%s: output of an old period changed: %s and %s", mode, first, again)
+		}
+
+		// A second anonymizer with the same secret produces the same output
+		var b = newTestAnonymizer(t, AnonymizePolicy{V4Mask: 32, V6Mask: 128, Mode: mode}, time.Hour)
+		if other := b.AnonymizeAt(addr, start); other != first {
+			t.Errorf("%s: anonymizers with the same secret disagree: %s and %s", mode, first, other)
+		}
+	}
+}
+
+func TestNewAnonymizerSecret(t *testing.T) {
+	for _, mode := range []AnonymizeMode{AnonymizeHMAC, AnonymizeCryptoPAn} {
+		if _, err := NewAnonymizer(AnonymizePolicy{Mode: mode}, nil, 0); err == nil {
+			t.Errorf("%s: no error for a missing secret", mode)
+		}
+		if _, err := NewAnonymizer(AnonymizePolicy{Mode: mode}, testSecret[:31], 0); err == nil {
+			t.Errorf("%s: no error for a short secret", mode)
+		}
+	}
+	if _, err := NewAnonymizer(AnonymizePolicy{Mode: AnonymizeMask}, nil, 0); err != nil {
+		t.Errorf("mask mode should not need a secret: %s", err)
+	}
+}
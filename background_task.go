@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"math/rand"
 	"sync"
 	"time"
@@ -49,3 +50,41 @@ func NewBackgroundTask(
 		}
 	}
 }
+
+// runLoop keeps track of a loop which was started in the background, so it can
+// be stopped again. It is used by the types which have Start and Stop methods
+type runLoop struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start runs the function in a new goroutine until the context is cancelled or
+// stop is called. If the loop is already running this does nothing
+func (rl *runLoop) start(ctx context.Context, run func(context.Context)) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.cancel != nil {
+		return
+	}
+
+	ctx, rl.cancel = context.WithCancel(ctx)
+	rl.done = make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		run(ctx)
+	}(rl.done)
+}
+
+// stop cancels the context of the loop and waits for it to exit
+func (rl *runLoop) stop() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.cancel == nil {
+		return
+	}
+
+	rl.cancel()
+	<-rl.done
+	rl.cancel, rl.done = nil, nil
+}
@@ -0,0 +1,227 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by BoundedPool.Get when the pool has been closed
+var ErrPoolClosed = errors.New("pool is closed")
+
+// BoundedPool is a pool of expensive objects, like database connections or
+// large decoders, with a fixed maximum number of live objects. Unlike Pool the
+// objects are never dropped by the garbage collector. When all objects are in
+// use Get blocks until one is returned.
+//
+// Every object which is taken with Get must be returned with either Put or
+// Discard, else the slot is lost forever. When the pool is no longer needed it
+// must be closed with Close, this stops the eviction goroutine
+type BoundedPool[T any] struct {
+	newFunc     func(context.Context) (T, error)
+	destroy     func(T)
+	healthCheck func(T) error
+	idleTimeout time.Duration
+
+	// slots limits the number of objects which can be checked out. Because
+	// objects are put back in the idle list before the slot is returned, this
+	// also limits the number of live objects
+	slots  chan struct{}
+	closed chan struct{}
+
+	mu       sync.Mutex
+	idle     []idleObject[T] // Used as a stack, the oldest objects are at the bottom
+	live     int
+	isClosed bool
+
+	loop runLoop
+}
+
+type idleObject[T any] struct {
+	obj   T
+	since time.Time
+}
+
+// NewBoundedPool creates a new bounded pool which holds at most maxObjects
+// live objects. newFunc creates a new object. destroy is called when an object
+// is removed from the pool, it is optional. healthCheck is called on idle
+// objects before they are handed out by Get, if it returns an error the object
+// is destroyed and another one is used. healthCheck is optional as well.
+// maxObjects is at least 1.
+//
+// Objects which have been idle for longer than idleTimeout are destroyed, an
+// idleTimeout of zero or less keeps idle objects forever. When idleTimeout is
+// set a background goroutine removes the expired objects, this goroutine runs
+// until Close is called. Always Close a pool which is no longer needed
+func NewBoundedPool[T any](
+	maxObjects int,
+	newFunc func(context.Context) (T, error),
+	destroy func(T),
+	healthCheck func(T) error,
+	idleTimeout time.Duration,
+) *BoundedPool[T] {
+	maxObjects = max(maxObjects, 1)
+	idleTimeout = max(idleTimeout, 0)
+
+	var p = &BoundedPool[T]{
+		newFunc:     newFunc,
+		destroy:     destroy,
+		healthCheck: healthCheck,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, maxObjects),
+		closed:      make(chan struct{}),
+	}
+	for range maxObjects {
+		p.slots <- struct{}{}
+	}
+
+	if idleTimeout > 0 {
+		p.loop.start(context.Background(), p.evictLoop)
+	}
+	return p
+}
+
+// Get takes an object from the pool. If there are no idle objects a new one is
+// created. If the maximum number of objects are in use Get blocks until one is
+// returned or the context is cancelled
+func (p *BoundedPool[T]) Get(ctx context.Context) (obj T, err error) {
+	select {
+	case <-p.slots:
+	case <-p.closed:
+		return obj, ErrPoolClosed
+	case <-ctx.Done():
+		return obj, ctx.Err()
+	}
+
+	for {
+		p.mu.Lock()
+		if p.isClosed {
+			p.mu.Unlock()
+			p.slots <- struct{}{}
+			return obj, ErrPoolClosed
+		}
+
+		if len(p.idle) == 0 {
+			// No idle objects, create a new one
+			p.live++
+			p.mu.Unlock()
+
+			if obj, err = p.newFunc(ctx); err != nil {
+				p.mu.Lock()
+				p.live--
+				p.mu.Unlock()
+				p.slots <- struct{}{}
+				return obj, err
+			}
+			return obj, nil
+		}
+
+		var idle = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.idleTimeout > 0 && time.Since(idle.since) > p.idleTimeout {
+			p.remove(idle.obj)
+			continue
+		}
+		if p.healthCheck != nil && p.healthCheck(idle.obj) != nil {
+			p.remove(idle.obj)
+			continue
+		}
+		return idle.obj, nil
+	}
+}
+
+// Put returns an object to the pool. If the pool is closed the object is
+// destroyed
+func (p *BoundedPool[T]) Put(obj T) {
+	p.mu.Lock()
+	if p.isClosed {
+		p.mu.Unlock()
+		p.remove(obj)
+	} else {
+		p.idle = append(p.idle, idleObject[T]{obj: obj, since: time.Now()})
+		p.mu.Unlock()
+	}
+	p.slots <- struct{}{}
+}
+
+// Discard destroys an object which was taken from the pool, for example
+// because it is broken. The next Get will create a new object in its place
+func (p *BoundedPool[T]) Discard(obj T) {
+	p.remove(obj)
+	p.slots <- struct{}{}
+}
+
+// Stats returns the number of live objects, including the ones which are
+// checked out, and the number of idle objects
+func (p *BoundedPool[T]) Stats() (live, idle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.live, len(p.idle)
+}
+
+// Close destroys all the idle objects in the pool. Objects which are checked
+// out are destroyed when they are returned. Waiting and future calls to Get
+// return ErrPoolClosed
+func (p *BoundedPool[T]) Close() {
+	p.mu.Lock()
+	if p.isClosed {
+		p.mu.Unlock()
+		return
+	}
+	p.isClosed = true
+	var idle = p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	close(p.closed)
+	p.loop.stop()
+
+	for _, o := range idle {
+		p.remove(o.obj)
+	}
+}
+
+// remove destroys an object and removes it from the live count
+func (p *BoundedPool[T]) remove(obj T) {
+	if p.destroy != nil {
+		p.destroy(obj)
+	}
+	p.mu.Lock()
+	p.live--
+	p.mu.Unlock()
+}
+
+// evictLoop periodically destroys the objects which have been idle for too
+// long
+func (p *BoundedPool[T]) evictLoop(ctx context.Context) {
+	// Very short timeouts would make the ticker spin or panic, check at most
+	// once per millisecond
+	var ticker = time.NewTicker(max(p.idleTimeout/2, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The oldest objects are at the bottom of the stack
+		p.mu.Lock()
+		var expired int
+		for expired < len(p.idle) && time.Since(p.idle[expired].since) > p.idleTimeout {
+			expired++
+		}
+		var evict = make([]idleObject[T], expired)
+		copy(evict, p.idle[:expired])
+		p.idle = append(p.idle[:0], p.idle[expired:]...)
+		p.mu.Unlock()
+
+		for _, o := range evict {
+			p.remove(o.obj)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package util
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// BytePool is a pool of byte slices with power-of-two size classes. Each size
+// class is backed by a Pool, so slices of very different sizes can be pooled
+// without handing out a huge buffer when a small one was requested.
+//
+// The pools hold a pointer to the first byte of the backing array instead of
+// a slice. Putting a slice in a sync.Pool would allocate a slice header on
+// every Put, the pointer can be stored without allocating. The size of the
+// array is known from the size class
+type BytePool struct {
+	minShift int
+	maxShift int
+	classes  []*Pool[*byte]
+}
+
+// NewBytePool creates a new byte slice pool. Slices smaller than minSize are
+// taken from the minSize class. Slices larger than maxSize are allocated
+// directly and not pooled. Both sizes are rounded up to a power of two
+func NewBytePool(minSize, maxSize int) *BytePool {
+	var bp = &BytePool{
+		minShift: bits.Len(uint(max(minSize, 1) - 1)),
+		maxShift: bits.Len(uint(max(maxSize, minSize, 1) - 1)),
+	}
+
+	for shift := bp.minShift; shift <= bp.maxShift; shift++ {
+		var size = 1 << shift
+		bp.classes = append(bp.classes, NewPool(func() *byte {
+			return unsafe.SliceData(make([]byte, size))
+		}))
+	}
+	return bp
+}
+
+// Get returns a slice with a length of n and a capacity of at least n. The
+// contents of the slice are not cleared. A negative n is treated as zero
+func (bp *BytePool) Get(n int) []byte {
+	n = max(n, 0)
+
+	// The class is the smallest power of two which fits n
+	var shift = max(bits.Len(uint(max(n, 1)-1)), bp.minShift)
+	if shift > bp.maxShift {
+		return make([]byte, n)
+	}
+	return unsafe.Slice(bp.classes[shift-bp.minShift].Get(), 1<<shift)[:n]
+}
+
+// Put returns a slice to the pool. The slice is put in the largest size class
+// which fits in its capacity, so slices which were not allocated by the pool
+// can be returned as well. Slices which are smaller than the smallest class or
+// larger than the largest class are dropped
+func (bp *BytePool) Put(b []byte) {
+	var c = cap(b)
+	if c == 0 {
+		return
+	}
+
+	// The class is the largest power of two which is not larger than the
+	// capacity
+	var shift = bits.Len(uint(c)) - 1
+	if shift < bp.minShift || shift > bp.maxShift {
+		return
+	}
+
+	bp.classes[shift-bp.minShift].Put(unsafe.SliceData(b[:1]))
+}
+
+// Stats returns the usage counters of each size class, keyed by the size of
+// the class
+func (bp *BytePool) Stats() map[int]PoolStats {
+	var stats = make(map[int]PoolStats, len(bp.classes))
+	for i, class := range bp.classes {
+		stats[1<<(bp.minShift+i)] = class.Stats()
+	}
+	return stats
+}
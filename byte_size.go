@@ -0,0 +1,73 @@
+package util
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// ByteSize is an amount of bytes which is printed and parsed in a readable
+// format like "5.000 GB". It can be used as a command line flag, and in
+// configuration structs which are decoded from JSON or any other format which
+// supports encoding.TextUnmarshaler. Plain byte counts are accepted as well
+type ByteSize int64
+
+// String returns the size formatted with FormatData
+func (b ByteSize) String() string { return FormatData(int64(b)) }
+
+// Set parses a size with ParseData. This implements flag.Value
+func (b *ByteSize) Set(s string) (err error) {
+	v, err := ParseData(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(v)
+	return nil
+}
+
+// Get returns the size as int64. This implements flag.Getter
+func (b *ByteSize) Get() any { return int64(*b) }
+
+// MarshalText formats the size with FormatData. FormatData rounds the size, so
+// if the rounded size differs from the real size the exact byte count is used
+// instead to make sure no information is lost
+func (b ByteSize) MarshalText() ([]byte, error) {
+	var s = b.String()
+	if v, err := ParseData(s); err == nil && v == int64(b) {
+		return []byte(s), nil
+	}
+	return strconv.AppendInt(nil, int64(b), 10), nil
+}
+
+// UnmarshalText parses a size with ParseData
+func (b *ByteSize) UnmarshalText(text []byte) error { return b.Set(string(text)) }
+
+// MarshalJSON encodes the size as a JSON string in the same format as
+// MarshalText
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	text, err := b.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON accepts both a JSON string which is parsed with ParseData and a
+// plain JSON number of bytes. Like the standard library types a JSON null
+// leaves the value unchanged
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Not a string, try to decode it as a number
+		var n int64
+		if err = json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*b = ByteSize(n)
+		return nil
+	}
+	return b.Set(s)
+}
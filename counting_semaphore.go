@@ -1,5 +1,11 @@
 package util
 
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
 // CountingSemaphore is a utility which limits the concurrent execution of a
 // function. When it is initialized it creates a channel with x capacity and
 // fills it with x slots. Every time the Acquire() function is called a slot is
@@ -8,6 +14,24 @@ package util
 type CountingSemaphore struct {
 	channel chan struct{}
 	slots   int
+
+	// Statistics
+	waiters     atomic.Int64
+	acquires    atomic.Uint64
+	tryFailures atomic.Uint64
+	totalWait   atomic.Int64
+	maxWait     atomic.Int64
+}
+
+// SemaphoreStats is a snapshot of the usage statistics of a CountingSemaphore
+type SemaphoreStats struct {
+	Slots       int           `json:"slots"`
+	InUse       int           `json:"in_use"`
+	Waiters     int           `json:"waiters"`
+	Acquires    uint64        `json:"acquires"`
+	TryFailures uint64        `json:"try_failures"`
+	TotalWait   time.Duration `json:"total_wait"`
+	MaxWait     time.Duration `json:"max_wait"`
 }
 
 // NewCountingSemaphore creates a new semaphore. The slots parameter is how many
@@ -30,9 +54,10 @@ func NewCountingSemaphore(slots int) (cs *CountingSemaphore) {
 // other threads are using the semaphore anymore. This essentially functions as
 // the Wait function of a WaitGroup.
 func (cs *CountingSemaphore) Wait() {
-	// Take all the slots
+	// Take all the slots. This skips Acquire so the wait is not counted in
+	// the statistics
 	for range cs.slots {
-		cs.Acquire()
+		<-cs.channel
 	}
 
 	// Release all the slots
@@ -43,6 +68,20 @@ func (cs *CountingSemaphore) Wait() {
 
 // Take a slot
 func (cs *CountingSemaphore) Try() (ok bool) {
+	select {
+	case <-cs.channel:
+		cs.acquires.Add(1)
+		return true
+	default:
+		cs.tryFailures.Add(1)
+		return false
+	}
+}
+
+// tryUncounted takes a slot if one is available without updating the
+// statistics. This is used for slots which are taken for bookkeeping instead
+// of for doing work
+func (cs *CountingSemaphore) tryUncounted() (ok bool) {
 	select {
 	case <-cs.channel:
 		return true
@@ -52,7 +91,40 @@ func (cs *CountingSemaphore) Try() (ok bool) {
 }
 
 // Take a slot
-func (cs *CountingSemaphore) Acquire() { <-cs.channel }
+func (cs *CountingSemaphore) Acquire() { _ = cs.AcquireContext(context.Background()) }
+
+// AcquireContext takes a slot. It blocks until a slot is available or the
+// context is cancelled. If the context is cancelled no slot is taken and the
+// error of the context is returned
+func (cs *CountingSemaphore) AcquireContext(ctx context.Context) error {
+	// Fast path, if a slot is available we don't need to measure the wait time
+	select {
+	case <-cs.channel:
+		cs.acquires.Add(1)
+		return nil
+	default:
+	}
+
+	cs.waiters.Add(1)
+	var start = time.Now()
+	select {
+	case <-cs.channel:
+	case <-ctx.Done():
+		cs.waiters.Add(-1)
+		return ctx.Err()
+	}
+	var wait = int64(time.Since(start))
+	cs.waiters.Add(-1)
+
+	cs.acquires.Add(1)
+	cs.totalWait.Add(wait)
+	for prev := cs.maxWait.Load(); wait > prev; prev = cs.maxWait.Load() {
+		if cs.maxWait.CompareAndSwap(prev, wait) {
+			break
+		}
+	}
+	return nil
+}
 
 // Release a slot
 func (cs *CountingSemaphore) Release() { cs.channel <- struct{}{} }
@@ -66,3 +138,16 @@ func (cs *CountingSemaphore) Exec(f func()) {
 		cs.Release()
 	}()
 }
+
+// Stats returns a snapshot of the usage statistics of the semaphore
+func (cs *CountingSemaphore) Stats() SemaphoreStats {
+	return SemaphoreStats{
+		Slots:       cs.slots,
+		InUse:       cs.slots - len(cs.channel),
+		Waiters:     int(cs.waiters.Load()),
+		Acquires:    cs.acquires.Load(),
+		TryFailures: cs.tryFailures.Load(),
+		TotalWait:   time.Duration(cs.totalWait.Load()),
+		MaxWait:     time.Duration(cs.maxWait.Load()),
+	}
+}
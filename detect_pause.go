@@ -1,34 +1,207 @@
 package util
 
 import (
+	"context"
+	"math"
 	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"slices"
 	"time"
 
 	"fornaxian.tech/log"
 )
 
-// DetectPauses runs a continuous loop which detects stalls in the runtime and
-// garbage collection cycles
-func DetectPauses() {
+// PauseEvent describes a long garbage collection pause or a scheduler stall
+// which was detected by a PauseDetector. The pause statistics cover the
+// individual stop-the-world pauses which ended since the previous poll
+type PauseEvent struct {
+	Time      time.Time // When the pause was detected
+	LongPause bool      // A GC pause exceeded the pause threshold
+	Stall     bool      // The tick drift exceeded the stall threshold
+
+	Pauses     int           // Number of GC pauses since the previous poll
+	Pause      time.Duration // Time spent in GC pauses since the previous poll
+	MaxPause   time.Duration // Longest single pause since the previous poll
+	P50Pause   time.Duration // Median pause since the previous poll
+	P90Pause   time.Duration // 90th percentile pause since the previous poll
+	P99Pause   time.Duration // 99th percentile pause since the previous poll
+	TotalPause time.Duration // Time spent in GC pauses since the program started
+	HeapInuse  uint64        // Bytes in in-use heap spans
+	NumGC      int64         // Number of completed GC cycles
+
+	// TickDrift is how much later than scheduled the detector woke up. A
+	// large drift means that the process did not get CPU time, because of
+	// CPU starvation, cgroup throttling or the host being paused
+	TickDrift  time.Duration
+	Goroutines int // Number of goroutines which currently exist
+	GOMAXPROCS int // Number of CPUs which can execute Go code simultaneously
+}
+
+// PauseDetector periodically checks the garbage collection pauses of the
+// runtime and how late its own timer fires. It calls a callback when a single
+// GC pause or the timer drift exceeds a threshold
+type PauseDetector struct {
+	interval       time.Duration
+	threshold      time.Duration
+	stallThreshold time.Duration
+	callback       func(PauseEvent)
+
+	loop runLoop
+}
+
+// NewPauseDetector creates a new pause detector. The detector will check the
+// GC statistics every interval and call the callback when a GC pause which
+// ended since the previous check took longer than threshold, or when the
+// detector woke up more than stallThreshold later than scheduled. An interval
+// of zero or less would make the detector spin, then the default interval of
+// one second is used. If the callback is nil the event will be logged
+func NewPauseDetector(
+	interval time.Duration,
+	threshold time.Duration,
+	stallThreshold time.Duration,
+	callback func(PauseEvent),
+) *PauseDetector {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if callback == nil {
+		callback = LogPauseEvent
+	}
+	return &PauseDetector{
+		interval:       interval,
+		threshold:      threshold,
+		stallThreshold: stallThreshold,
+		callback:       callback,
+	}
+}
+
+// LogPauseEvent logs a pause event as a warning. This is the default callback
+// of the PauseDetector
+func LogPauseEvent(ev PauseEvent) {
+	if ev.Stall {
+		log.Warn(
+			"Scheduler stall detected: tick drift: %.2fms, goroutines: %d, GOMAXPROCS: %d",
+			float64(ev.TickDrift)/1e6,
+			ev.Goroutines,
+			ev.GOMAXPROCS,
+		)
+	}
+	if !ev.LongPause {
+		return
+	}
+	log.Warn(
+		"Long GC detected: longest pause: %.2fms, %d pauses totalling %.2fms "+
+			"(p50 %.2fms, p90 %.2fms, p99 %.2fms), "+
+			"total time spent collecting garbage: %0.2fms, heap size: %s",
+		float64(ev.MaxPause)/1e6,
+		ev.Pauses,
+		float64(ev.Pause)/1e6,
+		float64(ev.P50Pause)/1e6,
+		float64(ev.P90Pause)/1e6,
+		float64(ev.P99Pause)/1e6,
+		float64(ev.TotalPause)/1e6,
+		FormatData(ev.HeapInuse),
+	)
+}
+
+// Start runs the detector in the background until the context is cancelled or
+// Stop is called. Calling Start on a detector which is already running has no
+// effect
+func (pd *PauseDetector) Start(ctx context.Context) { pd.loop.start(ctx, pd.Run) }
+
+// Stop stops a detector which was started with Start and waits for it to exit
+func (pd *PauseDetector) Stop() { pd.loop.stop() }
+
+// Run runs the detection loop in the current goroutine until the context is
+// cancelled.
+//
+// The GC statistics are read with debug.ReadGCStats and runtime/metrics, which
+// unlike runtime.ReadMemStats do not stop the world
+func (pd *PauseDetector) Run(ctx context.Context) {
 	var (
-		ticker = time.NewTicker(time.Second)
+		timer     = time.NewTimer(pd.interval)
+		scheduled = time.Now().Add(pd.interval)
 
 		// GC data
-		mstat     runtime.MemStats
-		prevPause uint64
+		gcStats   debug.GCStats
+		prevGC    int64
+		prevPause time.Duration
+		window    []time.Duration
+		heap      = []metrics.Sample{
+			{Name: "/memory/classes/heap/objects:bytes"},
+			{Name: "/memory/classes/heap/unused:bytes"},
+		}
 	)
-	for range ticker.C {
-		runtime.ReadMemStats(&mstat)
-		if mstat.PauseTotalNs != prevPause {
-			if mstat.PauseTotalNs-prevPause > 100e6 { // 100ms
-				log.Warn(
-					"Long GC detected: pause: %.2fms, total time spent collecting garbage: %0.2fms, heap size: %s",
-					float64(mstat.PauseTotalNs-prevPause)/1e6,
-					float64(mstat.PauseTotalNs)/1e6,
-					FormatData(int64(mstat.HeapInuse)),
-				)
-			}
-			prevPause = mstat.PauseTotalNs
+	defer timer.Stop()
+
+	debug.ReadGCStats(&gcStats)
+	prevGC, prevPause = gcStats.NumGC, gcStats.PauseTotal
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		// A timer is used instead of a ticker because a ticker drops ticks
+		// when the receiver is late, which would hide the drift
+		var now = time.Now()
+		var ev = PauseEvent{Time: now, TickDrift: max(now.Sub(scheduled), 0)}
+		ev.Stall = ev.TickDrift > pd.stallThreshold
+		scheduled = now.Add(pd.interval)
+		timer.Reset(pd.interval)
+
+		debug.ReadGCStats(&gcStats)
+		if gcStats.NumGC != prevGC {
+			// gcStats.Pause contains the most recent pauses first. The runtime
+			// only keeps the last 256 pauses, if more GC cycles occurred since
+			// the previous poll the oldest ones are lost
+			var cycles = gcStats.NumGC - prevGC
+			var kept = int(min(cycles, int64(len(gcStats.Pause))))
+
+			window = append(window[:0], gcStats.Pause[:kept]...)
+			slices.Sort(window)
+
+			ev.Pauses = int(cycles)
+			ev.Pause = gcStats.PauseTotal - prevPause
+			ev.MaxPause = window[len(window)-1]
+			ev.P50Pause = percentile(window, 0.50)
+			ev.P90Pause = percentile(window, 0.90)
+			ev.P99Pause = percentile(window, 0.99)
+			ev.LongPause = ev.MaxPause > pd.threshold
+		}
+		prevGC, prevPause = gcStats.NumGC, gcStats.PauseTotal
+
+		if !ev.LongPause && !ev.Stall {
+			continue
 		}
+
+		metrics.Read(heap)
+		ev.TotalPause = gcStats.PauseTotal
+		ev.HeapInuse = heap[0].Value.Uint64() + heap[1].Value.Uint64()
+		ev.NumGC = gcStats.NumGC
+		ev.Goroutines = runtime.NumGoroutine()
+		ev.GOMAXPROCS = runtime.GOMAXPROCS(0)
+		pd.callback(ev)
+	}
+}
+
+// percentile returns the nearest-rank percentile of a sorted slice of
+// durations. p must be between 0 and 1
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
 	}
+	var rank = int(math.Ceil(float64(len(sorted))*p)) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// DetectPauses runs a continuous loop which detects stalls in the runtime and
+// garbage collection cycles
+func DetectPauses() {
+	NewPauseDetector(
+		time.Second, 100*time.Millisecond, 100*time.Millisecond, nil,
+	).Run(context.Background())
 }
@@ -0,0 +1,191 @@
+package util
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// DirUsage contains the disk usage of a directory tree
+type DirUsage struct {
+	Path      string
+	Apparent  int64 // Sum of the file sizes in bytes
+	Allocated int64 // Bytes allocated on disk
+	Files     int64 // Number of files, symlinks and other non-directories
+	Dirs      int64 // Number of directories, including this one
+
+	// Subdirs contains the usage of the subdirectories, largest first. It is
+	// only filled up to the maxDepth passed to GetDirUsage
+	Subdirs []DirUsage
+}
+
+type dirUsageWalker struct {
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	cs       *CountingSemaphore
+	maxDepth int
+	oneFS    bool
+	dev      uint64
+
+	// Inodes with more than one link which have been counted already. Hard
+	// links are only counted once, like du does
+	mu   sync.Mutex
+	seen map[[2]uint64]struct{}
+}
+
+// GetDirUsage calculates the disk usage of a directory tree, like du. The tree
+// is walked with up to concurrency goroutines. Files with multiple hard links
+// are counted once. Subdirectory totals are included in the result up to
+// maxDepth levels deep, a maxDepth of zero only returns the total. If
+// oneFileSystem is true, directories on other filesystems than dir are
+// skipped. Files which are removed during the walk are ignored, other errors
+// abort the walk
+func GetDirUsage(
+	ctx context.Context,
+	dir string,
+	concurrency int,
+	maxDepth int,
+	oneFileSystem bool,
+) (usage DirUsage, err error) {
+	var st syscall.Stat_t
+	if err = syscall.Lstat(dir, &st); err != nil {
+		return usage, fmt.Errorf("failed to stat %s: %w", dir, err)
+	} else if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return usage, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var w = &dirUsageWalker{
+		ctx:      ctx,
+		cancel:   cancel,
+		cs:       NewCountingSemaphore(max(concurrency-1, 0)),
+		maxDepth: maxDepth,
+		oneFS:    oneFileSystem,
+		dev:      uint64(st.Dev),
+		seen:     make(map[[2]uint64]struct{}),
+	}
+
+	usage = w.walk(dir, &st, 0)
+	if err = context.Cause(ctx); err != nil {
+		return usage, err
+	}
+	return usage, nil
+}
+
+// walk calculates the usage of a directory. Subdirectories are walked in a new
+// goroutine if a semaphore slot is available, else they are walked in the
+// current goroutine. That way the walk can never deadlock on the semaphore
+func (w *dirUsageWalker) walk(dir string, st *syscall.Stat_t, depth int) (usage DirUsage) {
+	usage.Path = dir
+	usage.Dirs = 1
+	usage.Apparent = st.Size
+	usage.Allocated = st.Blocks * 512
+
+	if w.ctx.Err() != nil {
+		return usage
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.fail(err)
+		return usage
+	}
+
+	var (
+		wg       sync.WaitGroup
+		children = make([]DirUsage, 0, len(entries))
+		childMu  sync.Mutex
+	)
+	for _, entry := range entries {
+		if w.ctx.Err() != nil {
+			break
+		}
+
+		var path = filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			w.fail(err)
+			continue
+		}
+		var est, ok = info.Sys().(*syscall.Stat_t)
+		if !ok {
+			w.fail(fmt.Errorf("no stat information for %s", path))
+			continue
+		}
+
+		if !entry.IsDir() {
+			if est.Nlink > 1 && !w.firstLink(est) {
+				continue
+			}
+			usage.Files++
+			usage.Apparent += est.Size
+			usage.Allocated += est.Blocks * 512
+			continue
+		}
+
+		if w.oneFS && uint64(est.Dev) != w.dev {
+			continue
+		}
+
+		var walkChild = func() {
+			var child = w.walk(path, est, depth+1)
+			childMu.Lock()
+			children = append(children, child)
+			childMu.Unlock()
+		}
+		if w.cs.Try() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer w.cs.Release()
+				walkChild()
+			}()
+		} else {
+			walkChild()
+		}
+	}
+	wg.Wait()
+
+	for _, child := range children {
+		usage.Apparent += child.Apparent
+		usage.Allocated += child.Allocated
+		usage.Files += child.Files
+		usage.Dirs += child.Dirs
+	}
+
+	if depth < w.maxDepth && len(children) > 0 {
+		slices.SortFunc(children, func(a, b DirUsage) int {
+			return cmp.Compare(b.Allocated, a.Allocated)
+		})
+		usage.Subdirs = children
+	}
+	return usage
+}
+
+// firstLink returns true if this is the first time this inode is seen
+func (w *dirUsageWalker) firstLink(st *syscall.Stat_t) bool {
+	var key = [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.seen[key]; ok {
+		return false
+	}
+	w.seen[key] = struct{}{}
+	return true
+}
+
+// fail aborts the walk. Files which were removed while walking are ignored
+func (w *dirUsageWalker) fail(err error) {
+	if !errors.Is(err, fs.ErrNotExist) {
+		w.cancel(err)
+	}
+}
@@ -0,0 +1,329 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"time"
+
+	"fornaxian.tech/log"
+)
+
+// DiskSpaceLevel indicates how full a filesystem is
+type DiskSpaceLevel int
+
+const (
+	DiskSpaceOK DiskSpaceLevel = iota
+	DiskSpaceWarning
+	DiskSpaceCritical
+)
+
+func (l DiskSpaceLevel) String() string {
+	switch l {
+	case DiskSpaceOK:
+		return "ok"
+	case DiskSpaceWarning:
+		return "warning"
+	case DiskSpaceCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+// DiskSpaceEvent is emitted by the DiskSpaceMonitor when the free space of a
+// directory crosses a threshold. When Level is DiskSpaceOK the disk has
+// recovered
+type DiskSpaceEvent struct {
+	Dir      string
+	Level    DiskSpaceLevel
+	Previous DiskSpaceLevel
+	Stats    DiskStats
+}
+
+// DiskSpaceMonitor periodically checks the free space in a set of directories
+// and emits an event when the free space drops below or recovers above a
+// threshold. The latest statistics are cached, so HasRoom can be called
+// before every write without doing a syscall.
+//
+// Uploads can reserve the space they are about to use with Reserve. Reserved
+// space counts as used in HasRoom until the reservation is released, this prevents
+// concurrent uploads from racing each other into a full disk. Reservations are
+// tracked per filesystem, so directories on the same filesystem share them
+type DiskSpaceMonitor struct {
+	dirs       []string
+	interval   time.Duration
+	warnFree   uint64
+	critFree   uint64
+	hysteresis uint64
+	callback   func(DiskSpaceEvent)
+
+	mu       sync.Mutex
+	state    map[string]*diskSpaceState
+	devices  map[string]uint64 // Device ID of the monitored directories
+	reserved map[uint64]uint64 // Reserved bytes per device
+
+	loop runLoop
+}
+
+type diskSpaceState struct {
+	stats DiskStats
+	valid bool // False if the directory has not been checked yet
+	level DiskSpaceLevel
+}
+
+// NewDiskSpaceMonitor creates a new disk space monitor for a list of
+// directories. The directories are checked every interval. When the free space
+// drops below warnFree or critFree bytes a warning or critical event is sent
+// to the callback. To recover from a level the free space needs to rise
+// hysteresis bytes above the threshold, this prevents a flood of events when
+// the free space hovers around a threshold. An interval of zero or less uses
+// the default of one minute. If the callback is nil the events are logged
+func NewDiskSpaceMonitor(
+	dirs []string,
+	interval time.Duration,
+	warnFree, critFree, hysteresis uint64,
+	callback func(DiskSpaceEvent),
+) *DiskSpaceMonitor {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if callback == nil {
+		callback = LogDiskSpaceEvent
+	}
+
+	var m = &DiskSpaceMonitor{
+		dirs:       dirs,
+		interval:   interval,
+		warnFree:   warnFree,
+		critFree:   critFree,
+		hysteresis: hysteresis,
+		callback:   callback,
+		state:      make(map[string]*diskSpaceState, len(dirs)),
+		devices:    make(map[string]uint64, len(dirs)),
+		reserved:   make(map[uint64]uint64),
+	}
+	for _, dir := range dirs {
+		m.state[dir] = &diskSpaceState{}
+	}
+	return m
+}
+
+// LogDiskSpaceEvent logs a disk space event. This is the default callback of
+// the DiskSpaceMonitor
+func LogDiskSpaceEvent(ev DiskSpaceEvent) {
+	switch ev.Level {
+	case DiskSpaceOK:
+		log.Info(
+			"Disk space in %s recovered from %s: %s free of %s",
+			ev.Dir, ev.Previous, FormatData(ev.Stats.Free), FormatData(ev.Stats.Total),
+		)
+	case DiskSpaceWarning:
+		log.Warn(
+			"Disk space in %s is low: %s free of %s",
+			ev.Dir, FormatData(ev.Stats.Free), FormatData(ev.Stats.Total),
+		)
+	case DiskSpaceCritical:
+		log.Error(
+			"Disk space in %s is critically low: %s free of %s",
+			ev.Dir, FormatData(ev.Stats.Free), FormatData(ev.Stats.Total),
+		)
+	}
+}
+
+// Start runs the monitor in the background until the context is cancelled or
+// Stop is called
+func (m *DiskSpaceMonitor) Start(ctx context.Context) { m.loop.start(ctx, m.Run) }
+
+// Stop stops a monitor which was started with Start and waits for it to exit
+func (m *DiskSpaceMonitor) Stop() { m.loop.stop() }
+
+// Run checks the directories immediately and then every interval until the
+// context is cancelled
+func (m *DiskSpaceMonitor) Run(ctx context.Context) {
+	var ticker = time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.Poll()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll checks all the directories once and emits events for the directories
+// which crossed a threshold
+func (m *DiskSpaceMonitor) Poll() {
+	for _, dir := range m.dirs {
+		stats, err := GetDiskStats(dir)
+		if err != nil {
+			log.Error("Failed to get disk space of %s: %s", dir, err)
+			continue
+		}
+		dev, err := deviceID(dir)
+		if err != nil {
+			log.Error("Failed to get device of %s: %s", dir, err)
+			continue
+		}
+
+		m.mu.Lock()
+		m.devices[dir] = dev
+		var state = m.state[dir]
+		var prev = state.level
+		state.stats, state.valid = stats, true
+		state.level = m.level(stats.Free, prev)
+		var level = state.level
+		m.mu.Unlock()
+
+		if level != prev {
+			m.callback(DiskSpaceEvent{Dir: dir, Level: level, Previous: prev, Stats: stats})
+		}
+	}
+}
+
+// level returns the new level for an amount of free space. The thresholds of
+// the current level and the levels above it are raised by the hysteresis
+func (m *DiskSpaceMonitor) level(free uint64, current DiskSpaceLevel) DiskSpaceLevel {
+	var critLimit, warnLimit = m.critFree, m.warnFree
+	if current >= DiskSpaceCritical {
+		critLimit += m.hysteresis
+	}
+	if current >= DiskSpaceWarning {
+		warnLimit += m.hysteresis
+	}
+
+	if free < critLimit {
+		return DiskSpaceCritical
+	} else if free < warnLimit {
+		return DiskSpaceWarning
+	}
+	return DiskSpaceOK
+}
+
+// Stats returns the cached statistics of a monitored directory. ok is false if
+// the directory is not monitored or has not been checked yet
+func (m *DiskSpaceMonitor) Stats(dir string) (stats DiskStats, level DiskSpaceLevel, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.state[dir]
+	if !ok || !state.valid {
+		return stats, level, false
+	}
+	return state.stats, state.level, true
+}
+
+// HasRoom checks if n bytes can be written to a directory without the free
+// space dropping below the critical threshold. Reserved space on the same
+// filesystem is counted as used. For directories which are not monitored or
+// have not been checked yet the free space is looked up with a syscall
+func (m *DiskSpaceMonitor) HasRoom(dir string, n uint64) bool {
+	free, dev, ok := m.lookup(dir)
+	if !ok {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hasRoom(free, dev, n)
+}
+
+// lookup returns the free space and the device ID of a directory. The cached
+// statistics are used if they are available. The syscalls are done without
+// holding the mutex, so a hanging network filesystem does not block the other
+// directories. Only the device IDs of monitored directories are cached, else
+// the cache would grow with every directory callers pass in
+func (m *DiskSpaceMonitor) lookup(dir string) (free, dev uint64, ok bool) {
+	m.mu.Lock()
+	var state, monitored = m.state[dir]
+	if monitored && state.valid {
+		free, dev = state.stats.Free, m.devices[dir]
+		m.mu.Unlock()
+		return free, dev, true
+	}
+	m.mu.Unlock()
+
+	stats, err := GetDiskStats(dir)
+	if err != nil {
+		log.Error("Failed to get disk space of %s: %s", dir, err)
+		return 0, 0, false
+	}
+	if dev, err = deviceID(dir); err != nil {
+		log.Error("Failed to get device of %s: %s", dir, err)
+		return 0, 0, false
+	}
+	return stats.Free, dev, true
+}
+
+// hasRoom checks if n bytes fit in the free space of a device after the
+// critical threshold and the reservations have been subtracted. The mutex must
+// be held. The subtractions are checked one by one so a huge n can't overflow
+func (m *DiskSpaceMonitor) hasRoom(free, dev, n uint64) bool {
+	var reserved = m.reserved[dev]
+	if free < m.critFree || free-m.critFree < reserved {
+		return false
+	}
+	return n <= free-m.critFree-reserved
+}
+
+// DiskReservation is space which was claimed with DiskSpaceMonitor.Reserve.
+// It belongs to the filesystem the directory was on when it was reserved, so
+// it can be released even if the directory was removed in the meantime
+type DiskReservation struct {
+	m        *DiskSpaceMonitor
+	dev      uint64
+	n        uint64
+	released bool
+}
+
+// Reserve claims n bytes of space in a directory if there is room for it. The
+// reservation should be released with Release when the data has been written
+// or the write was aborted. Returns false if there is not enough room
+func (m *DiskSpaceMonitor) Reserve(dir string, n uint64) (res *DiskReservation, ok bool) {
+	free, dev, ok := m.lookup(dir)
+	if !ok {
+		return nil, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasRoom(free, dev, n) {
+		return nil, false
+	}
+	m.reserved[dev] += n
+	return &DiskReservation{m: m, dev: dev, n: n}, true
+}
+
+// Release returns the reserved space. Calling Release more than once has no
+// effect
+func (r *DiskReservation) Release() {
+	var m = r.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.released {
+		return
+	}
+	r.released = true
+
+	var reserved = m.reserved[r.dev]
+	reserved -= min(r.n, reserved)
+	if reserved == 0 {
+		delete(m.reserved, r.dev)
+	} else {
+		m.reserved[r.dev] = reserved
+	}
+}
+
+// deviceID returns the ID of the device which contains a directory
+func deviceID(dir string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
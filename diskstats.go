@@ -0,0 +1,147 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DiskIOInfo contains I/O statistics of a block device. The times are in
+// milliseconds. See the kernel's Documentation/admin-guide/iostats.rst for a
+// description of the fields. The discard fields are only available since Linux
+// 4.18 and the flush fields since Linux 5.5, on older kernels they are zero
+type DiskIOInfo struct {
+	Major  int
+	Minor  int
+	Device string
+
+	ReadsCompleted  int64
+	ReadsMerged     int64
+	SectorsRead     int64
+	ReadTime        int64
+	WritesCompleted int64
+	WritesMerged    int64
+	SectorsWritten  int64
+	WriteTime       int64
+	InFlight        int64 // I/Os currently in progress
+	IOTime          int64 // Time spent doing I/Os
+	WeightedIOTime  int64
+
+	DiscardsCompleted int64
+	DiscardsMerged    int64
+	SectorsDiscarded  int64
+	DiscardTime       int64
+
+	FlushesCompleted int64
+	FlushTime        int64
+}
+
+// ParseDiskIOInfo parses a file in the format of /proc/diskstats
+func ParseDiskIOInfo(r io.Reader) (disks []DiskIOInfo, err error) {
+	var scanner = bufio.NewScanner(r)
+	for scanner.Scan() {
+		var split = strings.Fields(scanner.Text())
+		if len(split) == 0 {
+			continue
+		} else if len(split) < 14 {
+			return disks, fmt.Errorf("invalid number of columns in diskstats file. %d instead of at least 14", len(split))
+		}
+
+		var inf = DiskIOInfo{Device: split[2]}
+		if inf.Major, err = strconv.Atoi(split[0]); err != nil {
+			return disks, fmt.Errorf("failed to parse major device number: %w", err)
+		}
+		if inf.Minor, err = strconv.Atoi(split[1]); err != nil {
+			return disks, fmt.Errorf("failed to parse minor device number: %w", err)
+		}
+
+		// The fields in order of appearance. Fields which are missing on older
+		// kernels are left at zero
+		var fields = []*int64{
+			&inf.ReadsCompleted, &inf.ReadsMerged, &inf.SectorsRead, &inf.ReadTime,
+			&inf.WritesCompleted, &inf.WritesMerged, &inf.SectorsWritten, &inf.WriteTime,
+			&inf.InFlight, &inf.IOTime, &inf.WeightedIOTime,
+			&inf.DiscardsCompleted, &inf.DiscardsMerged, &inf.SectorsDiscarded, &inf.DiscardTime,
+			&inf.FlushesCompleted, &inf.FlushTime,
+		}
+		for i, val := range split[3:min(len(split), 3+len(fields))] {
+			if *fields[i], err = strconv.ParseInt(val, 10, 64); err != nil {
+				return disks, fmt.Errorf("failed to parse column %d of device %s: %w", i+4, inf.Device, err)
+			}
+		}
+
+		disks = append(disks, inf)
+	}
+	return disks, scanner.Err()
+}
+
+func readDiskStats() ([]DiskIOInfo, error) {
+	file, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return nil, fmt.Errorf("could not open diskstats file: %w", err)
+	}
+	defer file.Close()
+
+	return ParseDiskIOInfo(file)
+}
+
+// GetDiskIOInfo reads Linux's /proc/diskstats file and returns the statistics
+// of a block device by name, like "sda" or "nvme0n1p1"
+func GetDiskIOInfo(device string) (inf DiskIOInfo, err error) {
+	disks, err := readDiskStats()
+	if err != nil {
+		return inf, err
+	}
+
+	for _, disk := range disks {
+		if disk.Device == device {
+			return disk, nil
+		}
+	}
+	return inf, fmt.Errorf("block device %s not found in diskstats file", device)
+}
+
+// GetDiskIOInfoForPath returns the statistics of the block device which holds
+// a file or directory. The device is looked up in the mount table with
+// MountForPath
+func GetDiskIOInfoForPath(dir string) (inf DiskIOInfo, err error) {
+	mount, err := MountForPath(dir)
+	if err != nil {
+		return inf, err
+	}
+
+	disks, err := readDiskStats()
+	if err != nil {
+		return inf, err
+	}
+
+	// Look the device up by device number first. Some filesystems like btrfs
+	// report an anonymous device number, then we fall back to the name of the
+	// source device. The source can be a symlink like /dev/mapper/root which
+	// points to the real device node /dev/dm-0
+	for _, disk := range disks {
+		if disk.Major == mount.Major && disk.Minor == mount.Minor {
+			return disk, nil
+		}
+	}
+
+	var source = mount.Source
+	if resolved, err := filepath.EvalSymlinks(source); err == nil {
+		source = resolved
+	}
+	source = filepath.Base(source)
+	for _, disk := range disks {
+		if disk.Device == source {
+			return disk, nil
+		}
+	}
+
+	return inf, fmt.Errorf(
+		"block device %d:%d (%s) for path %s not found in diskstats file",
+		mount.Major, mount.Minor, mount.Source, dir,
+	)
+}
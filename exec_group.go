@@ -0,0 +1,84 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ExecGroup runs functions concurrently using the slots of a
+// CountingSemaphore and collects their errors. Unlike CountingSemaphore.Wait
+// the Wait function of the group only waits for the functions which were
+// started through the group, not for other users of the semaphore
+type ExecGroup struct {
+	cs     *CountingSemaphore
+	wg     sync.WaitGroup
+	cancel context.CancelCauseFunc
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// Group creates a new execution group which uses the slots of this semaphore
+func (cs *CountingSemaphore) Group() *ExecGroup {
+	return &ExecGroup{cs: cs}
+}
+
+// GroupWithContext creates a new execution group and a derived context. The
+// context is cancelled when one of the functions in the group returns an error
+// or when Wait returns, whichever occurs first
+func (cs *CountingSemaphore) GroupWithContext(ctx context.Context) (*ExecGroup, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &ExecGroup{cs: cs, cancel: cancel}, ctx
+}
+
+// Go obtains an execution slot and runs the provided function concurrently.
+// Like CountingSemaphore.Exec this blocks until a slot is available
+func (g *ExecGroup) Go(f func() error) {
+	g.wg.Add(1)
+	g.cs.Acquire()
+	go func() {
+		defer g.wg.Done()
+		defer g.cs.Release()
+
+		if err := f(); err != nil {
+			g.mu.Lock()
+			g.errs = append(g.errs, err)
+			g.mu.Unlock()
+
+			if g.cancel != nil {
+				g.cancel(err)
+			}
+		}
+	}()
+}
+
+// Wait waits for all the functions in the group to finish and returns the
+// first error which occurred, if any
+func (g *ExecGroup) Wait() error {
+	g.wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.errs) > 0 {
+		return g.errs[0]
+	}
+	return nil
+}
+
+// WaitAll waits for all the functions in the group to finish and returns all
+// the errors which occurred, joined with errors.Join
+func (g *ExecGroup) WaitAll() error {
+	g.wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return errors.Join(g.errs...)
+}
+
+func (g *ExecGroup) wait() {
+	g.wg.Wait()
+	if g.cancel != nil {
+		g.cancel(nil)
+	}
+}
@@ -1,42 +1,142 @@
 package util
 
-import "fmt"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
 
+// Number is any integer or floating point type, including named types like
+// "type FileSize int64"
 type Number interface {
-	int | int64 | uint64 | float64
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
 }
 
+// DataFormat describes how FormatDataWith prints an amount of bytes
+type DataFormat struct {
+	// IEC uses binary units (KiB = 1024 bytes) instead of SI units (kB = 1000
+	// bytes)
+	IEC bool
+
+	// Precision is the number of significant digits to print, zero means the
+	// default of 4. If Fixed is true it is the number of digits after the
+	// decimal point instead. Amounts smaller than one kilobyte are always
+	// printed without decimals
+	Precision int
+	Fixed     bool
+
+	// Separator is placed between the number and the unit
+	Separator string
+
+	// LongUnits prints the full name of the unit, "kilobytes" instead of "kB"
+	LongUnits bool
+}
+
+// DefaultDataFormat is the format used by FormatData
+var DefaultDataFormat = DataFormat{Precision: 4, Separator: " "}
+
+var (
+	siUnits      = [...]string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
+	siUnitsLong  = [...]string{"bytes", "kilobytes", "megabytes", "gigabytes", "terabytes", "petabytes", "exabytes"}
+	iecUnits     = [...]string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	iecUnitsLong = [...]string{"bytes", "kibibytes", "mebibytes", "gibibytes", "tebibytes", "pebibytes", "exbibytes"}
+)
+
 // FormatData prints an amount of bytes in a readable rounded amount. The total
-// number of digits before and after the decimal point will always be 3.
+// number of digits before and after the decimal point will always be 4.
 func FormatData[T Number](size T) string {
-	var sizef = float64(size)
-
-	var fmtSize = func(n float64, u string) string {
-		var f string
-		if n >= 100 {
-			f = "%.1f"
-		} else if n >= 10 {
-			f = "%.2f"
-		} else {
-			f = "%.3f"
+	return FormatDataWith(size, DefaultDataFormat)
+}
+
+// FormatDataWith prints an amount of bytes in a readable rounded amount using
+// the provided format
+func FormatDataWith[T Number](size T, f DataFormat) string {
+	var (
+		base  = 1000.0
+		units = siUnits
+	)
+	if f.IEC {
+		base, units = 1024, iecUnits
+		if f.LongUnits {
+			units = iecUnitsLong
 		}
-		return fmt.Sprintf(f+" "+u, n)
+	} else if f.LongUnits {
+		units = siUnitsLong
 	}
+	return formatUnits(float64(size), base, units[:], f)
+}
 
-	if size >= 1e18 {
-		// An exabyte is the largest volume of data you can express in a signed
-		// 64-bit integer
-		return fmtSize(sizef/1e18, "EB")
-	} else if sizef >= 1e15 {
-		return fmtSize(sizef/1e15, "PB")
-	} else if sizef >= 1e12 {
-		return fmtSize(sizef/1e12, "TB")
-	} else if sizef >= 1e9 {
-		return fmtSize(sizef/1e9, "GB")
-	} else if sizef >= 1e6 {
-		return fmtSize(sizef/1e6, "MB")
-	} else if sizef >= 1e3 {
-		return fmtSize(sizef/1e3, "kB")
+// formatUnits formats a number using a list of units which are each base times
+// larger than the previous one
+func formatUnits(sizef, base float64, units []string, f DataFormat) string {
+	if math.IsInf(sizef, 0) || math.IsNaN(sizef) {
+		// These can't be scaled, they would make the digit counting loop
+		// forever
+		return strconv.FormatFloat(sizef, 'f', -1, 64) + f.Separator + units[len(units)-1]
+	}
+	if sizef < 0 {
+		// Negative sizes are used for deltas
+		return "-" + formatUnits(-sizef, base, units, f)
 	}
-	return fmt.Sprintf("%.0f B", sizef)
+	if !f.Fixed && f.Precision <= 0 {
+		f.Precision = DefaultDataFormat.Precision
+	}
+
+	// Find the largest unit which is smaller than the size. An exabyte is the
+	// largest volume of data you can express in a signed 64-bit integer
+	var exp = len(units) - 1
+	for ; exp > 0; exp-- {
+		if sizef >= math.Pow(base, float64(exp)) {
+			break
+		}
+	}
+
+	for {
+		var (
+			scaled   = sizef / math.Pow(base, float64(exp))
+			decimals = 0
+		)
+		if exp > 0 {
+			decimals = f.Precision
+			if !f.Fixed {
+				// Subtract the digits before the decimal point from the
+				// significant digits. If rounding adds a digit, like 99.996
+				// becoming 100.00, we need one decimal less
+				decimals = max(f.Precision-intDigits(scaled), 0)
+				if intDigits(roundTo(scaled, decimals)) > intDigits(scaled) {
+					decimals = max(decimals-1, 0)
+				}
+			}
+		}
+
+		// If rounding makes the number as large as the next unit we use the
+		// next unit instead. So 999.96 kB is printed as 1.000 MB
+		if exp < len(units)-1 && roundTo(scaled, decimals) >= base {
+			exp++
+			continue
+		}
+
+		var number, unit = strconv.FormatFloat(scaled, 'f', decimals, 64), units[exp]
+		if f.LongUnits && exp == 0 && number == "1" {
+			// The check is done after rounding, so 0.6 is "1 byte" as well
+			unit = strings.TrimSuffix(unit, "s")
+		}
+		return number + f.Separator + unit
+	}
+}
+
+// intDigits returns the number of digits before the decimal point
+func intDigits(n float64) (digits int) {
+	for digits = 1; n >= 10; n /= 10 {
+		digits++
+	}
+	return digits
+}
+
+// roundTo rounds a number to the given number of decimals
+func roundTo(n float64, decimals int) float64 {
+	var pow = math.Pow(10, float64(decimals))
+	return math.Round(n*pow) / pow
 }
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FormatDuration prints a duration in a compact readable format. Durations
+// shorter than a minute are printed in a single unit with at most three
+// significant digits, like "450 ms" or "12.3 s". Longer durations are printed
+// in two units, like "5m 12s", "2h 13m" or "3d 4h"
+func FormatDuration(d time.Duration) string {
+	if d == math.MinInt64 {
+		// This can't be negated. One nanosecond less makes no difference in
+		// the output
+		d++
+	}
+	if d < 0 {
+		return "-" + FormatDuration(-d)
+	}
+
+	if d < time.Minute {
+		for _, u := range [...]struct {
+			size time.Duration
+			name string
+		}{
+			{time.Nanosecond, "ns"},
+			{time.Microsecond, "µs"},
+			{time.Millisecond, "ms"},
+			{time.Second, "s"},
+		} {
+			var n = float64(d) / float64(u.size)
+			var rounded = roundTo(n, max(3-intDigits(n), 0))
+			if rounded >= 1000 {
+				continue // Rounding made the number too large for this unit
+			} else if u.size == time.Second && rounded >= 60 {
+				d = time.Minute
+				break
+			}
+			return strconv.FormatFloat(rounded, 'f', -1, 64) + " " + u.name
+		}
+	}
+
+	switch {
+	case d < time.Hour:
+		return fmt.Sprintf("%dm %ds", d/time.Minute, d%time.Minute/time.Second)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh %dm", d/time.Hour, d%time.Hour/time.Minute)
+	default:
+		return fmt.Sprintf("%dd %dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	}
+}
+
+// ParseDuration parses a duration in the format of FormatDuration, like
+// "450 ms" or "2h 13m". It accepts all the formats time.ParseDuration accepts,
+// with spaces between the numbers and units allowed and a "d" unit for days
+func ParseDuration(s string) (time.Duration, error) {
+	var trimmed = strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+
+	var neg bool
+	if strings.HasPrefix(trimmed, "-") {
+		neg, trimmed = true, trimmed[1:]
+	} else {
+		trimmed = strings.TrimPrefix(trimmed, "+")
+	}
+	if trimmed == "" {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+
+	// time.ParseDuration does not support days. None of the other units contain
+	// a "d", so everything before the "d" is the number of days
+	var d time.Duration
+	if days, rest, ok := strings.Cut(trimmed, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse days in duration '%s': %w", s, err)
+		}
+		d, trimmed = time.Duration(n*float64(24*time.Hour)), rest
+	}
+
+	if trimmed != "" {
+		rest, err := time.ParseDuration(trimmed)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse duration '%s': %w", s, err)
+		}
+		d += rest
+	}
+
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
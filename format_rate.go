@@ -0,0 +1,56 @@
+package util
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var bitRateUnits = [...]string{"bit/s", "kbit/s", "Mbit/s", "Gbit/s", "Tbit/s", "Pbit/s", "Ebit/s"}
+
+// rateFormat is the format used by FormatRate. Rates fluctuate, so they are
+// printed with one significant digit less than data sizes
+var rateFormat = DataFormat{Precision: 3, Separator: " "}
+
+// FormatRate prints a transfer speed in bytes per second in a readable rounded
+// amount with three significant digits, like "12.3 MB/s". If bits is true the
+// speed is converted to bits per second, like "98.1 Mbit/s"
+func FormatRate[T Number](bytesPerSecond T, bits bool) string {
+	if bits {
+		return formatUnits(float64(bytesPerSecond)*8, 1000, bitRateUnits[:], rateFormat)
+	}
+	return FormatDataWith(bytesPerSecond, rateFormat) + "/s"
+}
+
+// ParseRate parses a transfer speed like "12.3 MB/s", "98.1 Mbit/s" or
+// "100Mbps" and returns the speed in bytes per second. Units which end in "bit"
+// or a lower case "b" are bits, units ending in an upper case "B" are bytes.
+// The "/s" or "ps" suffix is optional. All the units accepted by ParseData are
+// accepted here as well
+func ParseRate(s string) (bytesPerSecond float64, err error) {
+	value, unit, err := splitNumberUnit(s)
+	if err != nil {
+		return 0, err
+	}
+
+	var lower = strings.ToLower(unit)
+	if strings.HasSuffix(lower, "/s") || strings.HasSuffix(lower, "ps") {
+		unit = strings.TrimSpace(unit[:len(unit)-2])
+		lower = strings.ToLower(unit)
+	}
+
+	if strings.HasSuffix(lower, "bit") || strings.HasSuffix(unit, "b") {
+		// Bits, strip the bit suffix so we can look up the prefix
+		unit = strings.TrimSuffix(strings.TrimSuffix(lower, "bit"), "b")
+		value.Quo(value, big.NewRat(8, 1))
+	}
+
+	multiplier, ok := dataUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown rate unit '%s' in '%s'", unit, s)
+	}
+	value.Mul(value, new(big.Rat).SetInt(multiplier))
+
+	bytesPerSecond, _ = value.Float64()
+	return bytesPerSecond, nil
+}
@@ -2,6 +2,37 @@ package util
 
 import "syscall"
 
+// DiskStats contains information about a filesystem
+type DiskStats struct {
+	Total     uint64 // Size of the filesystem in bytes
+	Used      uint64 // Bytes in use
+	Free      uint64 // Bytes available to unprivileged users
+	FreeRoot  uint64 // Bytes available to root, including the reserved blocks
+	BlockSize uint64 // Size of a block in bytes
+
+	Inodes     uint64 // Total number of inodes
+	InodesFree uint64 // Number of free inodes
+
+	FSType        uint64 // Filesystem magic number
+	FSTypeName    string // Name of the filesystem, "unknown" if it is not recognized
+	MountFlags    uint64 // Mount flags like MountReadOnly and MountNoExec, only on Linux
+	ReadOnly      bool   // The filesystem is mounted read-only
+	MaxNameLength int    // Maximum length of a filename, only on Linux
+}
+
+// Mount flags as reported by statfs on Linux
+const (
+	MountReadOnly   = 0x0001
+	MountNoSUID     = 0x0002
+	MountNoDev      = 0x0004
+	MountNoExec     = 0x0008
+	MountSync       = 0x0010
+	MountMandLock   = 0x0040
+	MountNoAtime    = 0x0400
+	MountNoDirAtime = 0x0800
+	MountRelAtime   = 0x1000
+)
+
 // FreeSpace uses a syscall to get the amount of free bytes in a directory
 func FreeSpace(dir string) (uint64, error) {
 	var statfs syscall.Statfs_t
@@ -10,7 +41,7 @@ func FreeSpace(dir string) (uint64, error) {
 		return 0, err
 	}
 
-	return statfs.Bavail * uint64(statfs.Bsize), nil
+	return clampUint64(statfs.Bavail) * uint64(statfs.Bsize), nil
 }
 
 // DiskSpace uses a syscall to get the size of a storage device
@@ -21,5 +52,16 @@ func DiskSpace(dir string) (uint64, error) {
 		return 0, err
 	}
 
-	return statfs.Blocks * uint64(statfs.Bsize), nil
+	return uint64(statfs.Blocks) * uint64(statfs.Bsize), nil
+}
+
+// clampUint64 converts a statfs counter to an uint64. Some platforms use signed
+// counters, on FreeBSD the available blocks go negative when the reserved
+// blocks are in use. Negative values are clamped to zero so they are not read
+// as a huge amount of free space
+func clampUint64[T ~int32 | ~int64 | ~uint32 | ~uint64](v T) uint64 {
+	if v < 0 {
+		return 0
+	}
+	return uint64(v)
 }
@@ -0,0 +1,44 @@
+//go:build darwin || freebsd
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// GetDiskStats uses a syscall to get information about the filesystem which
+// contains a directory. The mount flags and the maximum filename length are
+// not available on this platform
+func GetDiskStats(dir string) (stats DiskStats, err error) {
+	var statfs syscall.Statfs_t
+	if err = syscall.Statfs(dir, &statfs); err != nil {
+		return stats, fmt.Errorf("statfs failed: %w", err)
+	}
+
+	var bsize = uint64(statfs.Bsize)
+	stats.Total = uint64(statfs.Blocks) * bsize
+	stats.Used = (uint64(statfs.Blocks) - uint64(statfs.Bfree)) * bsize
+	stats.Free = clampUint64(statfs.Bavail) * bsize
+	stats.FreeRoot = uint64(statfs.Bfree) * bsize
+	stats.BlockSize = bsize
+
+	stats.Inodes = uint64(statfs.Files)
+	stats.InodesFree = clampUint64(statfs.Ffree)
+
+	stats.FSType = uint64(statfs.Type)
+	stats.FSTypeName = "unknown"
+	var name []byte
+	for _, c := range statfs.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	if len(name) > 0 {
+		stats.FSTypeName = string(name)
+	}
+	stats.ReadOnly = statfs.Flags&MountReadOnly != 0
+
+	return stats, nil
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// fsTypeNames maps the filesystem magic numbers from linux/magic.h to a name
+var fsTypeNames = map[uint64]string{
+	0x0000EF53: "ext4", // Also used by ext2 and ext3
+	0x58465342: "xfs",
+	0x9123683E: "btrfs",
+	0x2FC12FC1: "zfs",
+	0xCA451A4E: "bcachefs",
+	0xF2F52010: "f2fs",
+	0x3153464A: "jfs",
+	0x52654973: "reiserfs",
+	0x00003434: "nilfs",
+	0xE0F5E1E2: "erofs",
+	0x73717368: "squashfs",
+	0x00009660: "iso9660",
+	0x00004D44: "vfat",
+	0x2011BAB0: "exfat",
+	0x5346544E: "ntfs",
+	0x01021994: "tmpfs",
+	0x858458F6: "ramfs",
+	0x958458F6: "hugetlbfs",
+	0x794C7630: "overlayfs",
+	0x65735546: "fuse",
+	0x00006969: "nfs",
+	0xFF534D42: "cifs",
+	0xFE534D42: "smb2",
+	0x00C36400: "ceph",
+	0x01021997: "9p",
+	0x0000F15F: "ecryptfs",
+	0x00009FA0: "proc",
+	0x62656572: "sysfs",
+	0x00001CD1: "devpts",
+	0x63677270: "cgroup2",
+	0x0027E0EB: "cgroup",
+	0xCAFE4A11: "bpf",
+	0x64626720: "debugfs",
+	0x74726163: "tracefs",
+	0x73636673: "securityfs",
+	0x6165676C: "pstore",
+	0xDE5E81E4: "efivarfs",
+	0x19800202: "mqueue",
+	0x00000187: "autofs",
+	0x62656570: "configfs",
+}
+
+// GetDiskStats uses a syscall to get information about the filesystem which
+// contains a directory
+func GetDiskStats(dir string) (stats DiskStats, err error) {
+	var statfs syscall.Statfs_t
+	if err = syscall.Statfs(dir, &statfs); err != nil {
+		return stats, fmt.Errorf("statfs failed: %w", err)
+	}
+
+	// The block counts are in units of the fragment size. Very old kernels
+	// don't report the fragment size, then the block size is used
+	var frsize = uint64(statfs.Frsize)
+	if frsize == 0 {
+		frsize = uint64(statfs.Bsize)
+	}
+
+	stats.Total = statfs.Blocks * frsize
+	stats.Used = (statfs.Blocks - statfs.Bfree) * frsize
+	stats.Free = statfs.Bavail * frsize
+	stats.FreeRoot = statfs.Bfree * frsize
+	stats.BlockSize = uint64(statfs.Bsize)
+
+	stats.Inodes = statfs.Files
+	stats.InodesFree = statfs.Ffree
+
+	// Type is an int32 on 32-bit platforms, convert it to uint32 first so
+	// magic numbers with the high bit set are not sign extended
+	stats.FSType = uint64(uint32(statfs.Type))
+	if name, ok := fsTypeNames[stats.FSType]; ok {
+		stats.FSTypeName = name
+	} else {
+		stats.FSTypeName = "unknown"
+	}
+	stats.MountFlags = uint64(statfs.Flags)
+	stats.ReadOnly = stats.MountFlags&MountReadOnly != 0
+	stats.MaxNameLength = int(statfs.Namelen)
+
+	return stats, nil
+}
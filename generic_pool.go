@@ -2,28 +2,83 @@ package util
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 // A Pool is a generic wrapper around a sync.Pool.
 type Pool[T any] struct {
-	pool sync.Pool
+	pool     sync.Pool
+	reset    func(T)
+	validate func(T) bool
+
+	gets  atomic.Uint64
+	puts  atomic.Uint64
+	news  atomic.Uint64
+	drops atomic.Uint64
+}
+
+// PoolStats contains the usage counters of a Pool
+type PoolStats struct {
+	Gets  uint64 // Number of calls to Get
+	Puts  uint64 // Number of objects which were put back into the pool
+	News  uint64 // Number of objects created because the pool was empty
+	Drops uint64 // Number of objects rejected by the validate function
 }
 
 // New creates a new Pool with the provided new function.
 //
 // The equivalent sync.Pool construct is "sync.Pool{New: fn}"
 func NewPool[T any](newFunc func() T) *Pool[T] {
-	return &Pool[T]{
-		pool: sync.Pool{
-			New: func() interface{} {
-				return newFunc()
-			},
-		},
+	return NewPoolWithHooks(newFunc, nil, nil)
+}
+
+// NewPoolWithHooks creates a new Pool with a reset and a validate function,
+// both are optional. The reset function is called on every object which is
+// put into the pool, so callers don't have to remember to reset it. The
+// validate function is called before reset, if it returns false the object is
+// dropped instead of being put into the pool. This can be used to prevent
+// holding on to oversized objects:
+//
+//	var bufPool = NewPoolWithHooks(
+//		func() *bytes.Buffer { return new(bytes.Buffer) },
+//		func(b *bytes.Buffer) { b.Reset() },
+//		func(b *bytes.Buffer) bool { return b.Cap() <= 1<<20 },
+//	)
+func NewPoolWithHooks[T any](newFunc func() T, reset func(T), validate func(T) bool) *Pool[T] {
+	var p = &Pool[T]{reset: reset, validate: validate}
+	p.pool.New = func() any {
+		p.news.Add(1)
+		return newFunc()
 	}
+	return p
 }
 
 // Get is a generic wrapper around sync.Pool's Get method.
-func (p *Pool[T]) Get() T { return p.pool.Get().(T) }
+func (p *Pool[T]) Get() T {
+	p.gets.Add(1)
+	return p.pool.Get().(T)
+}
 
-// Put is a generic wrapper around sync.Pool's Put method.
-func (p *Pool[T]) Put(x T) { p.pool.Put(x) }
+// Put is a generic wrapper around sync.Pool's Put method. If the pool has a
+// validate function and the object is rejected it is dropped
+func (p *Pool[T]) Put(x T) {
+	if p.validate != nil && !p.validate(x) {
+		p.drops.Add(1)
+		return
+	}
+	if p.reset != nil {
+		p.reset(x)
+	}
+	p.puts.Add(1)
+	p.pool.Put(x)
+}
+
+// Stats returns the usage counters of the pool
+func (p *Pool[T]) Stats() PoolStats {
+	return PoolStats{
+		Gets:  p.gets.Load(),
+		Puts:  p.puts.Load(),
+		News:  p.news.Load(),
+		Drops: p.drops.Load(),
+	}
+}
@@ -0,0 +1,231 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"fornaxian.tech/log"
+)
+
+// GoroutineInfo describes a single goroutine from a goroutine dump
+type GoroutineInfo struct {
+	ID      int
+	Creator string // Function and location which started the goroutine
+	Stack   string // Full stack trace of the goroutine
+}
+
+// GoroutineGroup is a group of goroutines which were started from the same
+// location
+type GoroutineGroup struct {
+	Creator string
+	Count   int
+	Stack   string // Stack trace of one of the goroutines in the group
+}
+
+// Goroutines returns information about all the goroutines which currently
+// exist
+func Goroutines() []GoroutineInfo {
+	var buf bytes.Buffer
+	_ = pprof.Lookup("goroutine").WriteTo(&buf, 2)
+
+	var goroutines []GoroutineInfo
+	for block := range strings.SplitSeq(buf.String(), "\n\n") {
+		if g, ok := parseGoroutine(block); ok {
+			goroutines = append(goroutines, g)
+		}
+	}
+	return goroutines
+}
+
+// parseGoroutine parses one goroutine from a goroutine dump. The dump looks
+// like this:
+//
+//	goroutine 18 [chan receive]:
+//	main.worker()
+//		/src/main.go:20 +0x25
+//	created by main.main in goroutine 1
+//		/src/main.go:12 +0x1a
+func parseGoroutine(block string) (g GoroutineInfo, ok bool) {
+	block = strings.TrimSpace(block)
+	header, _, _ := strings.Cut(block, "\n")
+	if !strings.HasPrefix(header, "goroutine ") {
+		return g, false
+	}
+
+	idStr, _, _ := strings.Cut(strings.TrimPrefix(header, "goroutine "), " ")
+	var err error
+	if g.ID, err = strconv.Atoi(idStr); err != nil {
+		return g, false
+	}
+	g.Stack = block
+	g.Creator = "(no creator)"
+
+	if _, created, ok := strings.Cut(block, "\ncreated by "); ok {
+		var lines = strings.SplitN(created, "\n", 3)
+		var fn, _, _ = strings.Cut(lines[0], " in goroutine ")
+		g.Creator = fn
+		if len(lines) > 1 {
+			// Strip the program counter offset from the location
+			var loc, _, _ = strings.Cut(strings.TrimSpace(lines[1]), " +0x")
+			g.Creator += " (" + loc + ")"
+		}
+	}
+	return g, true
+}
+
+// GroupGoroutines groups goroutines by the location where they were created.
+// The largest groups come first
+func GroupGoroutines(goroutines []GoroutineInfo) []GoroutineGroup {
+	var groups = make(map[string]*GoroutineGroup)
+	for _, g := range goroutines {
+		if group, ok := groups[g.Creator]; ok {
+			group.Count++
+		} else {
+			groups[g.Creator] = &GoroutineGroup{Creator: g.Creator, Count: 1, Stack: g.Stack}
+		}
+	}
+
+	var sorted = make([]GoroutineGroup, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, *group)
+	}
+	slices.SortFunc(sorted, func(a, b GoroutineGroup) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Creator, b.Creator)
+	})
+	return sorted
+}
+
+// GoroutineLeakMonitor periodically samples the number of goroutines. When the
+// number of goroutines has grown in every sample of the window it logs the
+// locations which created the most goroutines
+type GoroutineLeakMonitor struct {
+	interval time.Duration
+	samples  int
+	top      int
+
+	loop runLoop
+}
+
+// NewGoroutineLeakMonitor creates a new goroutine leak monitor. The number of
+// goroutines is sampled every interval, when it has grown for samples
+// consecutive samples the top creators of goroutines are logged. An interval of
+// zero or less uses the default of one second
+func NewGoroutineLeakMonitor(interval time.Duration, samples, top int) *GoroutineLeakMonitor {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &GoroutineLeakMonitor{
+		interval: interval,
+		samples:  max(samples, 1),
+		top:      max(top, 0),
+	}
+}
+
+// Start runs the monitor in the background until the context is cancelled or
+// Stop is called
+func (m *GoroutineLeakMonitor) Start(ctx context.Context) { m.loop.start(ctx, m.Run) }
+
+// Stop stops a monitor which was started with Start and waits for it to exit
+func (m *GoroutineLeakMonitor) Stop() { m.loop.stop() }
+
+// Run runs the monitor loop in the current goroutine until the context is
+// cancelled
+func (m *GoroutineLeakMonitor) Run(ctx context.Context) {
+	var (
+		ticker = time.NewTicker(m.interval)
+		prev   = runtime.NumGoroutine()
+		start  = prev // Number of goroutines when the growth started
+		growth = 0    // Number of consecutive samples with growth
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var current = runtime.NumGoroutine()
+		if current <= prev {
+			prev, start, growth = current, current, 0
+			continue
+		}
+		prev = current
+		if growth++; growth < m.samples {
+			continue
+		}
+
+		var groups = GroupGoroutines(Goroutines())
+		log.Warn(
+			"Possible goroutine leak: number of goroutines grew from %d to %d in %d samples. Top creators:",
+			start, current, growth,
+		)
+		for _, group := range groups[:min(m.top, len(groups))] {
+			log.Warn("%6d goroutines created by %s", group.Count, group.Creator)
+		}
+
+		// Start counting again so we don't log every interval
+		start, growth = current, 0
+	}
+}
+
+// GoroutineLeakTB is the subset of testing.TB used by CheckGoroutineLeaks
+type GoroutineLeakTB interface {
+	Helper()
+	Cleanup(func())
+	Errorf(format string, args ...any)
+}
+
+// CheckGoroutineLeaks fails the test if goroutines which were started after
+// calling this function are still alive when the test ends. Goroutines get a
+// second to exit after the test has finished.
+//
+// Every goroutine which did not exist when this function was called counts as
+// a leak, including goroutines started by other tests. This means it can't be
+// used in tests which run in parallel with other tests (t.Parallel), because
+// their goroutines would be reported as leaks of this test. Call this at the
+// start of a test:
+//
+//	func TestWatcher(t *testing.T) {
+//		util.CheckGoroutineLeaks(t)
+//		...
+//	}
+func CheckGoroutineLeaks(t GoroutineLeakTB) {
+	t.Helper()
+
+	var before = make(map[int]struct{})
+	for _, g := range Goroutines() {
+		before[g.ID] = struct{}{}
+	}
+
+	t.Cleanup(func() {
+		t.Helper()
+
+		var leaked []GoroutineInfo
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+			leaked = leaked[:0]
+			for _, g := range Goroutines() {
+				if _, ok := before[g.ID]; !ok {
+					leaked = append(leaked, g)
+				}
+			}
+			if len(leaked) == 0 || time.Now().After(deadline) {
+				break
+			}
+		}
+
+		for _, g := range leaked {
+			t.Errorf("leaked goroutine created by %s:\n%s", g.Creator, g.Stack)
+		}
+	})
+}
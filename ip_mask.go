@@ -2,16 +2,37 @@ package util
 
 import (
 	"net"
+	"net/netip"
 )
 
 // IPMaskPrefix applies a netmask to an IPv4 or IPv6 address. Only the bits
-// inside the mask are retained, the remaining bits are set to 0
+// inside the mask are retained, the remaining bits are set to 0. IPv4-mapped
+// IPv6 addresses are treated as IPv4. Returns nil if the address or the mask
+// is invalid
 func IPMask(addr net.IP, v4mask, v6mask int) net.IP {
-	if addr.To4() != nil {
-		// This is a IPv4 address, apply the v4 mask
-		return addr.Mask(net.CIDRMask(v4mask, 32))
-	} else {
-		// This is a IPv6 address, apply the v6 mask
-		return addr.Mask(net.CIDRMask(v6mask, 128))
+	a, ok := netip.AddrFromSlice(addr)
+	if !ok {
+		return nil
 	}
+	return MaskAddr(a, v4mask, v6mask).AsSlice()
+}
+
+// MaskAddr applies a netmask to an IPv4 or IPv6 address. Only the bits inside
+// the mask are retained, the remaining bits are set to 0. IPv4-mapped IPv6
+// addresses are unmapped first, so they get the v4 mask and the result is a
+// plain IPv4 address. The IPv6 zone is removed. Returns the zero Addr if the
+// address or the mask is invalid
+func MaskAddr(addr netip.Addr, v4mask, v6mask int) netip.Addr {
+	addr = addr.Unmap()
+
+	var bits = v6mask
+	if addr.Is4() {
+		bits = v4mask
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return prefix.Addr()
 }
@@ -0,0 +1,180 @@
+package util
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IPRateLimiter limits the request rate per client address. Clients are
+// grouped by network with MaskAddr, because a single IPv6 client usually has a
+// whole /64 or larger at its disposal.
+//
+// The limiter uses the generic cell rate algorithm (GCRA), which behaves like
+// a token bucket but only needs to store one timestamp per client. The number
+// of tracked clients is bounded, when the limit is reached the least recently
+// seen client is forgotten
+type IPRateLimiter struct {
+	interval   time.Duration // Time it takes for one request to be refilled
+	burst      int
+	v4Mask     int
+	v6Mask     int
+	maxEntries int
+	exempt     *IPSet
+
+	mu      sync.Mutex
+	entries map[netip.Addr]*list.Element
+	lru     *list.List // Front is the most recently used
+}
+
+type ipRateEntry struct {
+	key netip.Addr
+	tat time.Time // Theoretical arrival time, when the bucket is full again
+}
+
+// RateLimitResult is the outcome of a rate limit check
+type RateLimitResult struct {
+	Allowed bool
+	Exempt  bool // The address is exempt from rate limiting
+
+	Limit      int           // Maximum number of requests in a burst
+	Remaining  int           // Number of requests which can be made right now
+	Reset      time.Duration // Time until the full burst is available again
+	RetryAfter time.Duration // Time until the next request is allowed, if it was denied
+}
+
+// NewIPRateLimiter creates a new rate limiter which allows rate requests per
+// period per client, with bursts of up to burst requests. IPv4 addresses are
+// grouped by the first v4Mask bits and IPv6 addresses by the first v6Mask
+// bits. At most maxEntries clients are tracked.
+//
+// The parameters are clamped to valid values: rate, burst and maxEntries are
+// at least 1 and the mask lengths are limited to the size of the address. The
+// time between two requests is at least one nanosecond, so a period of zero
+// effectively disables the limit.
+//
+// Local addresses, as reported by IsLocalAddr, are never limited. Addresses
+// in the exempt set aren't limited either, the set is optional. The set must
+// not be modified while the limiter is in use
+func NewIPRateLimiter(
+	rate int,
+	period time.Duration,
+	burst int,
+	v4Mask, v6Mask int,
+	maxEntries int,
+	exempt *IPSet,
+) *IPRateLimiter {
+	// A mask out of range would make MaskAddr return the zero Addr, which puts
+	// all clients in the same bucket
+	v4Mask = min(max(v4Mask, 0), 32)
+	v6Mask = min(max(v6Mask, 0), 128)
+
+	// The interval is used as divisor, it can't be zero. The burst is limited
+	// so the tolerance (interval * burst) can't overflow
+	var interval = max(period/time.Duration(max(rate, 1)), 1)
+	burst = min(max(burst, 1), int(min(math.MaxInt64/int64(interval), math.MaxInt32)))
+
+	return &IPRateLimiter{
+		interval:   interval,
+		burst:      burst,
+		v4Mask:     v4Mask,
+		v6Mask:     v6Mask,
+		maxEntries: max(maxEntries, 1),
+		exempt:     exempt,
+		entries:    make(map[netip.Addr]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Allow checks if a request from an address is allowed. If it is allowed it
+// is counted against the limit of the address
+func (l *IPRateLimiter) Allow(addr netip.Addr) RateLimitResult {
+	return l.allowAt(addr, time.Now())
+}
+
+func (l *IPRateLimiter) allowAt(addr netip.Addr, now time.Time) (res RateLimitResult) {
+	res.Limit = l.burst
+	if IsLocalAddr(addr) || (l.exempt != nil && l.exempt.Contains(addr)) {
+		res.Allowed, res.Exempt, res.Remaining = true, true, l.burst
+		return res
+	}
+
+	var key = MaskAddr(addr, l.v4Mask, l.v6Mask)
+	var tolerance = l.interval * time.Duration(l.burst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entry *ipRateEntry
+	if el, ok := l.entries[key]; ok {
+		l.lru.MoveToFront(el)
+		entry = el.Value.(*ipRateEntry)
+	} else {
+		if l.lru.Len() >= l.maxEntries {
+			var oldest = l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.entries, oldest.Value.(*ipRateEntry).key)
+		}
+		entry = &ipRateEntry{key: key, tat: now}
+		l.entries[key] = l.lru.PushFront(entry)
+	}
+
+	var tat = entry.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	var newTat = tat.Add(l.interval)
+
+	if newTat.Sub(now) > tolerance {
+		// The bucket is empty
+		res.RetryAfter = newTat.Sub(now) - tolerance
+		res.Reset = tat.Sub(now)
+		return res
+	}
+
+	entry.tat = newTat
+	res.Allowed = true
+	res.Remaining = int((tolerance - newTat.Sub(now)) / l.interval)
+	res.Reset = newTat.Sub(now)
+	return res
+}
+
+// Len returns the number of clients which are being tracked
+func (l *IPRateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lru.Len()
+}
+
+// Middleware returns a HTTP handler which rate limits the next handler. The
+// client address is resolved with RemoteAddrPort. Limited responses get the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers. When the
+// limit is exceeded the request is rejected with 429 Too Many Requests and a
+// Retry-After header
+func (l *IPRateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res = l.Allow(RemoteAddrPort(r).Addr())
+		if !res.Exempt {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("RateLimit-Reset", ceilSeconds(res.Reset))
+		}
+
+		if !res.Allowed {
+			w.Header().Set("Retry-After", ceilSeconds(res.RetryAfter))
+			http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ceilSeconds formats a duration as a whole number of seconds, rounded up
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,438 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"iter"
+	"math/bits"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// IPMap maps IP prefixes to values. Lookups return the value of the longest
+// prefix which contains an address. It is backed by a path-compressed binary
+// radix trie, so a lookup takes at most one step per bit of the address, no
+// matter how many prefixes are in the map.
+//
+// IPv4 and IPv6 prefixes are kept in separate trees. IPv4-mapped IPv6
+// addresses and prefixes are unmapped, so ::ffff:10.0.0.0/104 is the same as
+// 10.0.0.0/8 and ::ffff:10.1.2.3 matches it. The zero value is an empty map
+// ready to use. IPMap is not safe for concurrent writes
+type IPMap[V any] struct {
+	v4, v6 *ipTrieNode[V]
+	len    int
+}
+
+type ipTrieNode[V any] struct {
+	key      ipKey
+	bits     int
+	hasValue bool // Nodes without a value are only used to branch
+	value    V
+	child    [2]*ipTrieNode[V]
+}
+
+// ipKey is an address as a 128 bit number. IPv4 addresses are stored in the
+// top 32 bits
+type ipKey struct{ hi, lo uint64 }
+
+func ipKeyFrom(addr netip.Addr) ipKey {
+	if addr.Is4() {
+		var b = addr.As4()
+		return ipKey{hi: uint64(b[0])<<56 | uint64(b[1])<<48 | uint64(b[2])<<40 | uint64(b[3])<<32}
+	}
+	var b = addr.As16()
+	var k ipKey
+	for i := range 8 {
+		k.hi = k.hi<<8 | uint64(b[i])
+		k.lo = k.lo<<8 | uint64(b[i+8])
+	}
+	return k
+}
+
+func (k ipKey) addr(is4 bool) netip.Addr {
+	var b = k.bytes()
+	if is4 {
+		return netip.AddrFrom4([4]byte(b[:4]))
+	}
+	return netip.AddrFrom16(b)
+}
+
+// bytes returns the key in big endian byte order
+func (k ipKey) bytes() (b [16]byte) {
+	for i := range 8 {
+		b[i] = byte(k.hi >> (56 - 8*i))
+		b[i+8] = byte(k.lo >> (56 - 8*i))
+	}
+	return b
+}
+
+// bit returns bit i of the key, counting from the most significant bit
+func (k ipKey) bit(i int) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// commonBits returns the length of the common prefix of two keys, up to limit
+func (k ipKey) commonBits(o ipKey, limit int) int {
+	var n int
+	if x := k.hi ^ o.hi; x != 0 {
+		n = bits.LeadingZeros64(x)
+	} else {
+		n = 64 + bits.LeadingZeros64(k.lo^o.lo)
+	}
+	return min(n, limit)
+}
+
+// mask clears all bits after the first n bits
+func (k ipKey) mask(n int) ipKey {
+	switch {
+	case n <= 0:
+		return ipKey{}
+	case n < 64:
+		return ipKey{hi: k.hi &^ (1<<(64-n) - 1)}
+	case n < 128:
+		return ipKey{hi: k.hi, lo: k.lo &^ (1<<(128-n) - 1)}
+	}
+	return k
+}
+
+// normalizePrefix unmaps IPv4-mapped prefixes and clears the host bits. ok is
+// false if the prefix is invalid
+func normalizePrefix(p netip.Prefix) (_ netip.Prefix, ok bool) {
+	if !p.IsValid() {
+		return p, false
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), true
+}
+
+func (m *IPMap[V]) root(is4 bool) **ipTrieNode[V] {
+	if is4 {
+		return &m.v4
+	}
+	return &m.v6
+}
+
+// Insert adds a prefix to the map. If the prefix is already in the map its
+// value is replaced. Invalid prefixes are ignored
+func (m *IPMap[V]) Insert(prefix netip.Prefix, value V) {
+	prefix, ok := normalizePrefix(prefix)
+	if !ok {
+		return
+	}
+
+	var key, n = ipKeyFrom(prefix.Addr()), prefix.Bits()
+	var np = m.root(prefix.Addr().Is4())
+	for {
+		var node = *np
+		if node == nil {
+			*np = &ipTrieNode[V]{key: key, bits: n, hasValue: true, value: value}
+			m.len++
+			return
+		}
+
+		var common = node.key.commonBits(key, min(node.bits, n))
+		switch {
+		case common == node.bits && common == n:
+			// This is the same prefix
+			if !node.hasValue {
+				m.len++
+			}
+			node.hasValue, node.value = true, value
+			return
+		case common == node.bits:
+			// The node contains the new prefix, descend
+			np = &node.child[key.bit(node.bits)]
+		case common == n:
+			// The new prefix contains the node, insert it above the node
+			var parent = &ipTrieNode[V]{key: key, bits: n, hasValue: true, value: value}
+			parent.child[node.key.bit(n)] = node
+			*np = parent
+			m.len++
+			return
+		default:
+			// The prefixes diverge, insert a branch node where they split
+			var leaf = &ipTrieNode[V]{key: key, bits: n, hasValue: true, value: value}
+			var branch = &ipTrieNode[V]{key: key.mask(common), bits: common}
+			branch.child[key.bit(common)] = leaf
+			branch.child[node.key.bit(common)] = node
+			*np = branch
+			m.len++
+			return
+		}
+	}
+}
+
+// Remove removes a prefix from the map. Only an exact match is removed, the
+// prefixes inside it stay in the map. Returns false if the prefix was not in
+// the map
+func (m *IPMap[V]) Remove(prefix netip.Prefix) bool {
+	prefix, ok := normalizePrefix(prefix)
+	if !ok {
+		return false
+	}
+
+	var np = m.root(prefix.Addr().Is4())
+	*np, ok = (*np).remove(ipKeyFrom(prefix.Addr()), prefix.Bits())
+	if ok {
+		m.len--
+	}
+	return ok
+}
+
+// remove removes a prefix from the subtree and returns the new root of the
+// subtree. Branch nodes which are no longer needed are collapsed
+func (node *ipTrieNode[V]) remove(key ipKey, n int) (_ *ipTrieNode[V], ok bool) {
+	if node == nil || node.bits > n || node.key.commonBits(key, node.bits) < node.bits {
+		return node, false
+	}
+
+	if node.bits == n {
+		if !node.hasValue {
+			return node, false
+		}
+		var zero V
+		node.hasValue, node.value = false, zero
+	} else {
+		var c = key.bit(node.bits)
+		if node.child[c], ok = node.child[c].remove(key, n); !ok {
+			return node, false
+		}
+	}
+
+	if node.hasValue {
+		return node, true
+	} else if node.child[0] == nil {
+		return node.child[1], true
+	} else if node.child[1] == nil {
+		return node.child[0], true
+	}
+	return node, true
+}
+
+// Lookup finds the longest prefix in the map which contains the address.
+// Returns false if no prefix matches
+func (m *IPMap[V]) Lookup(addr netip.Addr) (value V, prefix netip.Prefix, ok bool) {
+	addr = addr.WithZone("").Unmap()
+	if !addr.IsValid() {
+		return value, prefix, false
+	}
+
+	var key, maxBits = ipKeyFrom(addr), addr.BitLen()
+	var match *ipTrieNode[V]
+	for node := *m.root(addr.Is4()); node != nil; {
+		if node.key.commonBits(key, node.bits) < node.bits {
+			break
+		}
+		if node.hasValue {
+			match = node
+		}
+		if node.bits == maxBits {
+			break
+		}
+		node = node.child[key.bit(node.bits)]
+	}
+
+	if match == nil {
+		return value, prefix, false
+	}
+	return match.value, netip.PrefixFrom(match.key.addr(addr.Is4()), match.bits), true
+}
+
+// Contains returns true if the address is inside any of the prefixes in the
+// map
+func (m *IPMap[V]) Contains(addr netip.Addr) bool {
+	_, _, ok := m.Lookup(addr)
+	return ok
+}
+
+// Len returns the number of prefixes in the map
+func (m *IPMap[V]) Len() int { return m.len }
+
+// All iterates over the prefixes in the map and their values. The IPv4
+// prefixes come first. The prefixes are sorted by address, a prefix comes
+// before the prefixes it contains
+func (m *IPMap[V]) All() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		_ = m.v4.walk(true, yield) && m.v6.walk(false, yield)
+	}
+}
+
+func (node *ipTrieNode[V]) walk(is4 bool, yield func(netip.Prefix, V) bool) bool {
+	if node == nil {
+		return true
+	}
+	if node.hasValue && !yield(netip.PrefixFrom(node.key.addr(is4), node.bits), node.value) {
+		return false
+	}
+	return node.child[0].walk(is4, yield) && node.child[1].walk(is4, yield)
+}
+
+// IPSet is a set of IP prefixes, like a blocklist. It is an IPMap without
+// values. The zero value is an empty set ready to use. IPSet is not safe for
+// concurrent writes
+type IPSet struct {
+	m IPMap[struct{}]
+}
+
+// Insert adds a prefix to the set. Invalid prefixes are ignored
+func (s *IPSet) Insert(prefix netip.Prefix) { s.m.Insert(prefix, struct{}{}) }
+
+// Remove removes a prefix from the set. Only an exact match is removed.
+// Returns false if the prefix was not in the set
+func (s *IPSet) Remove(prefix netip.Prefix) bool { return s.m.Remove(prefix) }
+
+// Contains returns true if the address is inside any of the prefixes in the
+// set
+func (s *IPSet) Contains(addr netip.Addr) bool { return s.m.Contains(addr) }
+
+// Match returns the longest prefix in the set which contains the address.
+// Returns false if no prefix matches
+func (s *IPSet) Match(addr netip.Addr) (prefix netip.Prefix, ok bool) {
+	_, prefix, ok = s.m.Lookup(addr)
+	return prefix, ok
+}
+
+// Len returns the number of prefixes in the set
+func (s *IPSet) Len() int { return s.m.Len() }
+
+// Prefixes returns the prefixes in the set. The IPv4 prefixes come first,
+// sorted by address
+func (s *IPSet) Prefixes() []netip.Prefix {
+	var prefixes = make([]netip.Prefix, 0, s.m.Len())
+	for p := range s.m.All() {
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+// Compact rewrites the set to the smallest list of prefixes which covers the
+// same addresses. Prefixes which are inside another prefix are removed and
+// adjacent prefixes are merged, so 10.0.0.0/25 and 10.0.0.128/25 become
+// 10.0.0.0/24
+func (s *IPSet) Compact() {
+	s.m.v4 = compactTrie(s.m.v4)
+	s.m.v6 = compactTrie(s.m.v6)
+	s.m.len = 0
+	for range s.m.All() {
+		s.m.len++
+	}
+}
+
+// compactTrie rebuilds a tree with the minimal list of prefixes. The tree is
+// walked in address order, so siblings which can be merged always end up next
+// to each other on the stack
+func compactTrie(root *ipTrieNode[struct{}]) *ipTrieNode[struct{}] {
+	type entry struct {
+		key  ipKey
+		bits int
+	}
+	var stack []entry
+	var walk func(node *ipTrieNode[struct{}])
+	walk = func(node *ipTrieNode[struct{}]) {
+		if node == nil {
+			return
+		}
+		if node.hasValue {
+			// Everything below this node is covered by it
+			var e = entry{node.key, node.bits}
+			for len(stack) > 0 {
+				var top = stack[len(stack)-1]
+				if top.bits != e.bits || e.bits == 0 ||
+					top.key.commonBits(e.key, e.bits) != e.bits-1 || e.key.bit(e.bits-1) != 1 {
+					break
+				}
+				// The top of the stack is the lower half of the parent prefix
+				stack = stack[:len(stack)-1]
+				e = entry{top.key, e.bits - 1}
+			}
+			stack = append(stack, e)
+			return
+		}
+		walk(node.child[0])
+		walk(node.child[1])
+	}
+	walk(root)
+
+	var compacted *ipTrieNode[struct{}]
+	for _, e := range stack {
+		insertSorted(&compacted, e.key, e.bits)
+	}
+	return compacted
+}
+
+// insertSorted inserts a key into a tree. The prefixes must be inserted in
+// address order and may not overlap, so the new prefix always diverges from
+// the tree somewhere on the rightmost path
+func insertSorted[V any](np **ipTrieNode[V], key ipKey, n int) {
+	for {
+		var node = *np
+		if node == nil {
+			*np = &ipTrieNode[V]{key: key, bits: n, hasValue: true}
+			return
+		}
+		var common = node.key.commonBits(key, min(node.bits, n))
+		if common == node.bits {
+			np = &node.child[key.bit(node.bits)]
+			continue
+		}
+		var branch = &ipTrieNode[V]{key: key.mask(common), bits: common}
+		branch.child[0] = node
+		branch.child[1] = &ipTrieNode[V]{key: key, bits: n, hasValue: true}
+		*np = branch
+		return
+	}
+}
+
+// LoadIPSet reads a list of prefixes from a file. See ReadIPSet for the format
+func LoadIPSet(file string) (*IPSet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadIPSet(f)
+}
+
+// ReadIPSet reads a list of prefixes. The list has one prefix in CIDR
+// notation per line, a bare address is read as a prefix with only that
+// address. Empty lines and everything after a # are ignored
+func ReadIPSet(r io.Reader) (*IPSet, error) {
+	var (
+		set     = &IPSet{}
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+	for scanner.Scan() {
+		line++
+		var text, _, _ = strings.Cut(scanner.Text(), "#")
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+
+		var prefix netip.Prefix
+		if strings.Contains(text, "/") {
+			var err error
+			if prefix, err = netip.ParsePrefix(text); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		} else {
+			addr, err := netip.ParseAddr(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			prefix = netip.PrefixFrom(addr.WithZone(""), addr.BitLen())
+		}
+		set.Insert(prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
@@ -0,0 +1,198 @@
+package util
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// randomPrefix returns a prefix from a small address range, so the prefixes
+// overlap often
+func randomPrefix(r *rand.Rand) netip.Prefix {
+	if r.IntN(2) == 0 {
+		var addr = netip.AddrFrom4([4]byte{10, byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256))})
+		return netip.PrefixFrom(addr, 8+r.IntN(25)).Masked()
+	}
+	var addr = netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(r.IntN(4)), 15: byte(r.IntN(256))})
+	return netip.PrefixFrom(addr, 16+r.IntN(113)).Masked()
+}
+
+func randomAddr(r *rand.Rand) netip.Addr {
+	if r.IntN(2) == 0 {
+		return netip.AddrFrom4([4]byte{10, byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256))})
+	}
+	return netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, byte(r.IntN(4)), 15: byte(r.IntN(256))})
+}
+
+// naiveLookup finds the longest matching prefix with a linear scan
+func naiveLookup(prefixes map[netip.Prefix]int, addr netip.Addr) (value int, match netip.Prefix, ok bool) {
+	for p, v := range prefixes {
+		if p.Contains(addr) && (!ok || p.Bits() > match.Bits()) {
+			value, match, ok = v, p, true
+		}
+	}
+	return value, match, ok
+}
+
+func TestIPMapLookup(t *testing.T) {
+	var r = rand.New(rand.NewPCG(1, 2))
+
+	for round := range 100 {
+		var m IPMap[int]
+		var naive = make(map[netip.Prefix]int)
+
+		for i := range 200 {
+			var p = randomPrefix(r)
+			if r.IntN(3) == 0 {
+				var _, exists = naive[p]
+				if removed := m.Remove(p); removed != exists {
+					t.Fatalf("round %d: Remove(%s) = %t, want %t", round, p, removed, exists)
+				}
+				delete(naive, p)
+			} else {
+				m.Insert(p, i)
+				naive[p] = i
+			}
+		}
+
+		if m.Len() != len(naive) {
+			t.Fatalf("round %d: Len() = %d, want %d", round, m.Len(), len(naive))
+		}
+		var count int
+		for p, v := range m.All() {
+			if want, ok := naive[p]; !ok || want != v {
+				t.Fatalf("round %d: All() returned %s = %d, which is not in the map", round, p, v)
+			}
+			count++
+		}
+		if count != len(naive) {
+			t.Fatalf("round %d: All() returned %d prefixes, want %d", round, count, len(naive))
+		}
+
+		for range 500 {
+			var addr = randomAddr(r)
+			var wantValue, wantPrefix, wantOK = naiveLookup(naive, addr)
+			var value, prefix, ok = m.Lookup(addr)
+			if ok != wantOK || prefix != wantPrefix || value != wantValue {
+				t.Fatalf(
+					"round %d: Lookup(%s) = %d, %s, %t, want %d, %s, %t",
+					round, addr, value, prefix, ok, wantValue, wantPrefix, wantOK,
+				)
+			}
+		}
+	}
+}
+
+func TestIPMapMapped(t *testing.T) {
+	var m IPMap[string]
+	m.Insert(netip.MustParsePrefix("::ffff:10.0.0.0/104"), "mapped")
+
+	value, prefix, ok := m.Lookup(netip.MustParseAddr("10.1.2.3"))
+	if !ok || value != "mapped" || prefix != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Fatalf("Lookup(10.1.2.3) = %q, %s, %t", value, prefix, ok)
+	}
+	if !m.Contains(netip.MustParseAddr("::ffff:10.9.9.9")) {
+		t.Fatal("mapped address does not match the IPv4 prefix")
+	}
+	if !m.Remove(netip.MustParsePrefix("10.0.0.0/8")) || m.Len() != 0 {
+		t.Fatal("failed to remove the prefix by its IPv4 form")
+	}
+}
+
+func TestIPSetCompact(t *testing.T) {
+	var r = rand.New(rand.NewPCG(3, 4))
+
+	for round := range 100 {
+		var set IPSet
+		for range 100 {
+			set.Insert(randomPrefix(r))
+		}
+
+		var addrs = make(map[netip.Addr]bool)
+		for range 2000 {
+			var addr = randomAddr(r)
+			addrs[addr] = set.Contains(addr)
+		}
+
+		var before = set.Len()
+		set.Compact()
+		if set.Len() > before {
+			t.Fatalf("round %d: Compact grew the set from %d to %d prefixes", round, before, set.Len())
+		}
+
+		for addr, want := range addrs {
+			if set.Contains(addr) != want {
+				t.Fatalf("round %d: Contains(%s) changed to %t after Compact", round, addr, !want)
+			}
+		}
+
+		var prefixes = set.Prefixes()
+		for i := range prefixes {
+			for j := i + 1; j < len(prefixes); j++ {
+				if prefixes[i].Overlaps(prefixes[j]) {
+					t.Fatalf("round %d: %s and %s overlap after Compact", round, prefixes[i], prefixes[j])
+				}
+			}
+		}
+	}
+}
+
+func TestIPSetCompactMerge(t *testing.T) {
+	var set IPSet
+	for _, p := range []string{
+		"10.0.0.0/25",
+		"10.0.0.128/26",
+		"10.0.0.192/26",
+		"10.0.1.0/24",
+		"10.0.1.5/32", // Inside 10.0.1.0/24
+		"10.0.2.5/32",
+	} {
+		set.Insert(netip.MustParsePrefix(p))
+	}
+	set.Compact()
+
+	var got = set.Prefixes()
+	var want = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/23"),
+		netip.MustParsePrefix("10.0.2.5/32"),
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Prefixes() = %v, want %v", got, want)
+	}
+	if set.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", set.Len(), len(want))
+	}
+}
+
+func TestReadIPSet(t *testing.T) {
+	set, err := ReadIPSet(strings.NewReader(
+		"# Blocklist\n" +
+			"192.0.2.0/24\n" +
+			"\n" +
+			"198.51.100.7 # a single address\n" +
+			"2001:db8::/32\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", set.Len())
+	}
+	for addr, want := range map[string]bool{
+		"192.0.2.200":  true,
+		"198.51.100.7": true,
+		"198.51.100.8": false,
+		"2001:db8::1":  true,
+		"2001:db9::1":  false,
+	} {
+		if set.Contains(netip.MustParseAddr(addr)) != want {
+			t.Errorf("Contains(%s) = %t, want %t", addr, !want, want)
+		}
+	}
+
+	if _, err = ReadIPSet(strings.NewReader("192.0.2.0/24\nnot an address\n")); err == nil ||
+		!strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("expected an error on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MountInfo contains information about a mount point. See proc(5) for a
+// description of the fields
+type MountInfo struct {
+	MountID        int
+	ParentID       int
+	Major          int      // Major device number of the filesystem
+	Minor          int      // Minor device number of the filesystem
+	Root           string   // Directory in the filesystem which forms the root of this mount
+	MountPoint     string   // Where the filesystem is mounted
+	Options        []string // Per-mount options like "rw" and "noatime"
+	OptionalFields []string // Propagation fields like "shared:1"
+	FSType         string   // Filesystem type, like "ext4"
+	Source         string   // Filesystem specific source, often a device like "/dev/sda1"
+	SuperOptions   []string // Per-superblock options
+}
+
+// GetMountInfo reads and parses Linux's /proc/self/mountinfo file
+func GetMountInfo() ([]MountInfo, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("could not open mountinfo file: %w", err)
+	}
+	defer file.Close()
+
+	return ParseMountInfo(file)
+}
+
+// ParseMountInfo parses a file in the format of /proc/self/mountinfo
+func ParseMountInfo(r io.Reader) (mounts []MountInfo, err error) {
+	var scanner = bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		m, err := parseMountInfoLine(scanner.Text())
+		if err != nil {
+			return mounts, err
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// parseMountInfoLine parses a single line of a mountinfo file, which looks
+// like this:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfoLine(line string) (m MountInfo, err error) {
+	var fields = strings.Fields(line)
+
+	// The optional fields are terminated by a single hyphen
+	var sep = -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep == -1 || len(fields) < sep+3 {
+		return m, fmt.Errorf("invalid mountinfo line '%s'", line)
+	}
+
+	if m.MountID, err = strconv.Atoi(fields[0]); err != nil {
+		return m, fmt.Errorf("failed to parse mount id: %w", err)
+	}
+	if m.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return m, fmt.Errorf("failed to parse parent id: %w", err)
+	}
+
+	major, minor, ok := strings.Cut(fields[2], ":")
+	if !ok {
+		return m, fmt.Errorf("could not split device number '%s'", fields[2])
+	}
+	if m.Major, err = strconv.Atoi(major); err != nil {
+		return m, fmt.Errorf("failed to parse major device number: %w", err)
+	}
+	if m.Minor, err = strconv.Atoi(minor); err != nil {
+		return m, fmt.Errorf("failed to parse minor device number: %w", err)
+	}
+
+	m.Root = unescapeMountField(fields[3])
+	m.MountPoint = unescapeMountField(fields[4])
+	m.Options = strings.Split(fields[5], ",")
+	m.OptionalFields = fields[6:sep]
+	m.FSType = unescapeMountField(fields[sep+1])
+	m.Source = unescapeMountField(fields[sep+2])
+	if len(fields) > sep+3 {
+		m.SuperOptions = strings.Split(fields[sep+3], ",")
+	}
+	return m, nil
+}
+
+// unescapeMountField decodes the octal escapes the kernel uses for spaces,
+// tabs, newlines and backslashes in paths, like "\040" for a space
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// MountForPath returns the mount which contains a file or directory. Symbolic
+// links in the path are resolved first
+func MountForPath(dir string) (m MountInfo, err error) {
+	if dir, err = filepath.Abs(dir); err != nil {
+		return m, err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return m, err
+	}
+
+	mounts, err := GetMountInfo()
+	if err != nil {
+		return m, err
+	}
+
+	m, ok := FindMount(mounts, dir)
+	if !ok {
+		return m, fmt.Errorf("no mount found for path %s", dir)
+	}
+	return m, nil
+}
+
+// FindMount returns the mount from the list which contains an absolute path.
+// This is the mount with the longest mount point which is a parent of the
+// path. When multiple filesystems are mounted on the same mount point the last
+// one wins, because it hides the others
+func FindMount(mounts []MountInfo, path string) (m MountInfo, ok bool) {
+	path = filepath.Clean(path)
+
+	var bestLen = -1
+	for _, mount := range mounts {
+		var mp = filepath.Clean(mount.MountPoint)
+		if path != mp && mp != "/" && !strings.HasPrefix(path, mp+"/") {
+			continue
+		}
+		if len(mp) >= bestLen {
+			m, bestLen, ok = mount, len(mp), true
+		}
+	}
+	return m, ok
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// dataUnits maps all the accepted spellings of a data unit, in lower case, to
+// the number of bytes in the unit
+var dataUnits = map[string]*big.Int{"": big.NewInt(1)}
+
+func init() {
+	for exp := range siUnits {
+		var si = new(big.Int).Exp(big.NewInt(1000), big.NewInt(int64(exp)), nil)
+		var iec = new(big.Int).Exp(big.NewInt(1024), big.NewInt(int64(exp)), nil)
+
+		dataUnits[strings.ToLower(siUnits[exp])] = si
+		dataUnits[siUnitsLong[exp]] = si
+		dataUnits[strings.TrimSuffix(siUnitsLong[exp], "s")] = si
+		dataUnits[strings.ToLower(iecUnits[exp])] = iec
+		dataUnits[iecUnitsLong[exp]] = iec
+		dataUnits[strings.TrimSuffix(iecUnitsLong[exp], "s")] = iec
+
+		if exp > 0 {
+			// Short forms like "1.5T" and "512Ki" are also accepted
+			var prefix = strings.ToLower(siUnits[exp][:1])
+			dataUnits[prefix] = si
+			dataUnits[prefix+"i"] = iec
+		}
+	}
+}
+
+// ParseData parses a human-readable amount of bytes like "10 GB", "512MiB" or
+// "1.5T" and returns the number of bytes. SI (kB, MB) and IEC (KiB, MiB) units
+// are accepted, single letter units are treated as SI units. Units are case
+// insensitive and can be separated from the number with spaces. A number
+// without a unit is a plain byte count. Fractional byte counts are rounded to
+// the nearest integer. An error is returned if the amount does not fit in an
+// int64
+func ParseData(s string) (int64, error) {
+	value, unit, err := splitNumberUnit(s)
+	if err != nil {
+		return 0, err
+	}
+
+	multiplier, ok := dataUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown data unit '%s' in '%s'", unit, s)
+	}
+	value.Mul(value, new(big.Rat).SetInt(multiplier))
+
+	// Round to the nearest integer, halves are rounded away from zero
+	var half = big.NewRat(1, 2)
+	if value.Sign() < 0 {
+		half.Neg(half)
+	}
+	value.Add(value, half)
+	var rounded = new(big.Int).Quo(value.Num(), value.Denom())
+
+	if !rounded.IsInt64() {
+		return 0, fmt.Errorf("data size '%s' overflows int64, maximum is %d", s, int64(math.MaxInt64))
+	}
+	return rounded.Int64(), nil
+}
+
+// splitNumberUnit splits a string like "1.5 GB" into the number and the unit.
+// The number is parsed exactly
+func splitNumberUnit(s string) (value *big.Rat, unit string, err error) {
+	var trimmed = strings.TrimSpace(s)
+
+	var split = strings.IndexFunc(trimmed, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-' && r != '+'
+	})
+	if split == -1 {
+		split = len(trimmed)
+	}
+	var num = trimmed[:split]
+	unit = strings.TrimSpace(trimmed[split:])
+
+	value, ok := new(big.Rat).SetString(num)
+	if !ok || num == "" {
+		return nil, "", fmt.Errorf("failed to parse number '%s' in '%s'", num, s)
+	}
+	return value, unit, nil
+}
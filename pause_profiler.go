@@ -0,0 +1,203 @@
+package util
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fornaxian.tech/log"
+)
+
+// PauseProfiler captures a heap profile, a goroutine dump and a CPU profile
+// when a long pause or stall is detected. Each capture is saved in its own
+// subdirectory of the configured directory. The Capture function can be used
+// as callback for a PauseDetector:
+//
+//	var profiler = NewPauseProfiler("/var/tmp/pauses", time.Hour, 10*time.Second, 10, 1e9)
+//	var detector = NewPauseDetector(time.Second, 100*time.Millisecond, time.Second, func(ev PauseEvent) {
+//		LogPauseEvent(ev)
+//		profiler.Capture(ev)
+//	})
+type PauseProfiler struct {
+	dir         string
+	minInterval time.Duration
+	cpuDuration time.Duration
+	keep        int
+	maxBytes    uint64
+
+	mu          sync.Mutex
+	lastCapture time.Time
+	capturing   bool
+}
+
+// NewPauseProfiler creates a new pause profiler which saves its captures in
+// dir. At most one capture is made per minInterval. The CPU profile will be
+// recorded for cpuDuration, a duration of zero disables the CPU profile. Only
+// the last keep captures are retained and the oldest captures are removed
+// when the captures take up more than maxBytes. A capture is skipped when the
+// filesystem has less than maxBytes of free space
+func NewPauseProfiler(
+	dir string,
+	minInterval time.Duration,
+	cpuDuration time.Duration,
+	keep int,
+	maxBytes uint64,
+) *PauseProfiler {
+	return &PauseProfiler{
+		dir:         dir,
+		minInterval: minInterval,
+		cpuDuration: cpuDuration,
+		keep:        keep,
+		maxBytes:    maxBytes,
+	}
+}
+
+// Capture starts capturing profiles in the background. If a capture is already
+// running or the previous capture was less than minInterval ago the event is
+// ignored
+func (pp *PauseProfiler) Capture(ev PauseEvent) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.capturing || time.Since(pp.lastCapture) < pp.minInterval {
+		return
+	}
+
+	pp.capturing = true
+	pp.lastCapture = ev.Time
+	go func() {
+		if err := pp.capture(ev); err != nil {
+			log.Error("Failed to capture pause profiles: %s", err)
+		}
+
+		pp.mu.Lock()
+		pp.capturing = false
+		pp.mu.Unlock()
+	}()
+}
+
+func (pp *PauseProfiler) capture(ev PauseEvent) (err error) {
+	if err = os.MkdirAll(pp.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create profile directory: %w", err)
+	}
+
+	if free, err := FreeSpace(pp.dir); err != nil {
+		return fmt.Errorf("failed to get free space: %w", err)
+	} else if free < pp.maxBytes {
+		log.Warn(
+			"Not capturing pause profiles, only %s of free space left in %s",
+			FormatData(free), pp.dir,
+		)
+		return nil
+	}
+
+	var dir = filepath.Join(pp.dir, "pause-"+ev.Time.UTC().Format("20060102-150405.000"))
+	if err = os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create capture directory: %w", err)
+	}
+
+	// Rotate the old captures when we're done, even if the capture failed
+	defer func() {
+		if rotateErr := pp.rotate(); rotateErr != nil && err == nil {
+			err = rotateErr
+		}
+	}()
+
+	if err = os.WriteFile(
+		filepath.Join(dir, "event.txt"), fmt.Appendf(nil, "%+v\n", ev), 0644,
+	); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+	if err = writeProfile(filepath.Join(dir, "heap.pprof"), "heap", 0); err != nil {
+		return err
+	}
+	if err = writeProfile(filepath.Join(dir, "goroutine.txt"), "goroutine", 2); err != nil {
+		return err
+	}
+
+	if pp.cpuDuration > 0 {
+		file, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+		if err != nil {
+			return fmt.Errorf("failed to create CPU profile: %w", err)
+		}
+		defer file.Close()
+
+		// This fails if a CPU profile is already running, for example
+		// through net/http/pprof
+		if err = pprof.StartCPUProfile(file); err != nil {
+			return fmt.Errorf("failed to start CPU profile: %w", err)
+		}
+		time.Sleep(pp.cpuDuration)
+		pprof.StopCPUProfile()
+	}
+
+	log.Info("Captured pause profiles in %s", dir)
+	return nil
+}
+
+func writeProfile(path, name string, debug int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s profile: %w", name, err)
+	}
+	defer file.Close()
+
+	if err = pprof.Lookup(name).WriteTo(file, debug); err != nil {
+		return fmt.Errorf("failed to write %s profile: %w", name, err)
+	}
+	return file.Close()
+}
+
+// rotate removes the oldest captures until there are at most keep captures
+// left and they use at most maxBytes of disk space
+func (pp *PauseProfiler) rotate() error {
+	entries, err := os.ReadDir(pp.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list captures: %w", err)
+	}
+
+	type capture struct {
+		path string
+		size uint64
+	}
+	var (
+		captures []capture
+		total    uint64
+	)
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "pause-") {
+			continue
+		}
+
+		var c = capture{path: filepath.Join(pp.dir, entry.Name())}
+		_ = filepath.WalkDir(c.path, func(_ string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					c.size += uint64(info.Size())
+				}
+			}
+			return nil
+		})
+		captures = append(captures, c)
+		total += c.size
+	}
+
+	// The directory names start with a timestamp, so sorting them by name puts
+	// the oldest captures first
+	sort.Slice(captures, func(i, j int) bool { return captures[i].path < captures[j].path })
+
+	for len(captures) > 0 && (len(captures) > pp.keep || total > pp.maxBytes) {
+		if err = os.RemoveAll(captures[0].path); err != nil {
+			return fmt.Errorf("failed to remove old capture: %w", err)
+		}
+		log.Debug("Removed old pause capture %s", captures[0].path)
+		total -= captures[0].size
+		captures = captures[1:]
+	}
+	return nil
+}
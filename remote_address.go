@@ -4,67 +4,100 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 )
 
-var privateIPBlocks []*net.IPNet
-
-func init() {
-	for _, cidr := range []string{
-		"127.0.0.0/8",    // IPv4 loopback
-		"10.0.0.0/8",     // RFC1918
-		"172.16.0.0/12",  // RFC1918
-		"192.168.0.0/16", // RFC1918
-		"::1/128",        // IPv6 loopback
-		"fe80::/10",      // IPv6 link-local
-		"fc00::/7",       // IPv6 unique local addr
-	} {
-		_, block, _ := net.ParseCIDR(cidr)
-		privateIPBlocks = append(privateIPBlocks, block)
-	}
+var privateIPBlocks = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),    // IPv4 loopback
+	netip.MustParsePrefix("10.0.0.0/8"),     // RFC1918
+	netip.MustParsePrefix("172.16.0.0/12"),  // RFC1918
+	netip.MustParsePrefix("192.168.0.0/16"), // RFC1918
+	netip.MustParsePrefix("::1/128"),        // IPv6 loopback
+	netip.MustParsePrefix("fe80::/10"),      // IPv6 link-local
+	netip.MustParsePrefix("fc00::/7"),       // IPv6 unique local addr
 }
 
+// unixSocketAddr is used as remote address for requests coming in over a unix
+// domain socket, those have "@" as RemoteAddr
+var unixSocketAddr = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 80)
+
 // RemoteAddress resolves the address of a HTTP request to the real remote
 // address. It takes in account proxies if the request is originated from a
 // private IP range
 func RemoteAddress(r *http.Request) (addr string) {
-	var err error
-	addr = r.RemoteAddr
-
-	if addr == "@" { // Support unix domain sockets
-		addr = "127.0.0.1:80"
+	if addrPort := RemoteAddrPort(r); addrPort.IsValid() {
+		return addrPort.Addr().String()
 	}
 
-	addr, _, err = net.SplitHostPort(addr)
+	// The host is not an IP address, like "localhost:80" from a custom
+	// listener. Return the host as-is. Hosts which are not IP addresses are
+	// never local, so the proxy headers are not trusted
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		panic(fmt.Errorf("failed to parse request RemoteAddr: %s", err))
 	}
+	return addr
+}
 
-	if AddressIsLocal(addr) {
+// RemoteAddrPort resolves the address of a HTTP request to the real remote
+// address. If the request comes from a private IP range the X-Real-IP and
+// X-Forwarded-For headers are trusted. The proxy headers do not contain the
+// remote port, so the port is 0 when the address was taken from a header. If a
+// header contains an invalid address it is ignored.
+//
+// IPv4-mapped IPv6 addresses are unmapped, so an IPv4 client always has an
+// IPv4 address. Returns the zero AddrPort if the RemoteAddr of the request
+// can't be parsed
+func RemoteAddrPort(r *http.Request) netip.AddrPort {
+	var addrPort netip.AddrPort
+	if r.RemoteAddr == "@" { // Support unix domain sockets
+		addrPort = unixSocketAddr
+	} else {
+		var err error
+		if addrPort, err = netip.ParseAddrPort(r.RemoteAddr); err != nil {
+			return netip.AddrPort{}
+		}
+		addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+	}
+
+	if IsLocalAddr(addrPort.Addr()) {
 		// This IP is in a private range, so we can trust its proxy headers,
 		// check if it has any
 		if h := r.Header.Get("X-Real-IP"); h != "" {
-			return h
+			if addr, err := netip.ParseAddr(strings.TrimSpace(h)); err == nil {
+				return netip.AddrPortFrom(addr.Unmap(), 0)
+			}
 		} else if h := r.Header.Get("X-Forwarded-For"); h != "" {
-			return strings.Split(h, ", ")[0]
+			h, _, _ = strings.Cut(h, ",")
+			if addr, err := netip.ParseAddr(strings.TrimSpace(h)); err == nil {
+				return netip.AddrPortFrom(addr.Unmap(), 0)
+			}
 		}
 	}
 
-	return addr
+	return addrPort
 }
 
 // AddressIsLocal checks if an IP address falls on a private subnet
 func AddressIsLocal(ip string) bool {
 	if ip == "@" { // Support unix domain sockets
-		ip = "127.0.0.1"
+		return true
 	}
 
-	ipp := net.ParseIP(ip)
-	if ipp == nil {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
 		return false
 	}
+	return IsLocalAddr(addr)
+}
+
+// IsLocalAddr checks if an IP address falls on a private subnet. IPv4-mapped
+// IPv6 addresses are checked against the IPv4 ranges
+func IsLocalAddr(addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
 	for _, block := range privateIPBlocks {
-		if block.Contains(ipp) {
+		if block.Contains(addr) {
 			return true
 		}
 	}
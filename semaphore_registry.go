@@ -0,0 +1,61 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+var (
+	semaphoreRegistry   = make(map[string]*CountingSemaphore)
+	semaphoreRegistryMu sync.Mutex
+)
+
+// NewNamedCountingSemaphore creates a new semaphore and adds it to the
+// semaphore registry under the given name. If a semaphore with the same name
+// was already registered it will be replaced
+func NewNamedCountingSemaphore(name string, slots int) *CountingSemaphore {
+	var cs = NewCountingSemaphore(slots)
+	RegisterSemaphore(name, cs)
+	return cs
+}
+
+// RegisterSemaphore adds a semaphore to the registry so its statistics will be
+// included in AllSemaphoreStats
+func RegisterSemaphore(name string, cs *CountingSemaphore) {
+	semaphoreRegistryMu.Lock()
+	semaphoreRegistry[name] = cs
+	semaphoreRegistryMu.Unlock()
+}
+
+// UnregisterSemaphore removes a semaphore from the registry
+func UnregisterSemaphore(name string) {
+	semaphoreRegistryMu.Lock()
+	delete(semaphoreRegistry, name)
+	semaphoreRegistryMu.Unlock()
+}
+
+// AllSemaphoreStats returns the statistics of all registered semaphores, keyed
+// by name
+func AllSemaphoreStats() map[string]SemaphoreStats {
+	semaphoreRegistryMu.Lock()
+	defer semaphoreRegistryMu.Unlock()
+
+	var stats = make(map[string]SemaphoreStats, len(semaphoreRegistry))
+	for name, cs := range semaphoreRegistry {
+		stats[name] = cs.Stats()
+	}
+	return stats
+}
+
+// SemaphoreStatsHandler is a HTTP handler which responds with the statistics of
+// all registered semaphores in JSON format. It can be mounted on a debug
+// endpoint
+func SemaphoreStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var enc = json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(AllSemaphoreStats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}